@@ -1,8 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"container/list"
 	"context"
+	crand "crypto/rand"
 	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -39,23 +52,103 @@ import (
 
 type APIClientConfig struct {
 	BaseURL        string
-	DefaultTimeout time.Duration
-	MaxRetries     int
-	RateLimit      int // requests per minute - размер token bucket
+	DefaultTimeout time.Duration // таймаут одной попытки запроса
+	MaxRetries     int           // повторов после первой попытки, если в RetryPolicy не задан MaxAttempts
+	RateLimit      int           // запросов в минуту, токены пополняются равномерно. По умолчанию 100
+	Burst          int           // сколько запросов можно отправить подряд без ожидания, по умолчанию 1
+	HTTPClient     *http.Client  // по умолчанию http.DefaultClient
+	Clock          Clock         // по умолчанию системное время, в тестах - FakeClock
+	// UrgentWeight - сколько urgent-запросов подряд отправляется, прежде чем пропустить обычный, по умолчанию 4
+	UrgentWeight int
+	// MaxQueueWait - после такого ожидания в очереди обычный запрос отправляется раньше urgent-запросов, по умолчанию 5s
+	MaxQueueWait time.Duration
+	// QueueSize - сколько запросов может ждать отправки, по умолчанию RateLimit.
+	// Что делать с запросом, когда очередь заполнена, определяет OverloadPolicy
+	QueueSize      int
+	OverloadPolicy OverloadPolicy
+	Workers        int // сколько запросов выполняется одновременно, по умолчанию 10
+	// RetryPolicy - политика повторов по умолчанию, запрос может переопределить ее через Request.Retry
+	RetryPolicy RetryPolicy
+	// DisableIdempotencyKeys - не генерировать Idempotency-Key для POST и PATCH запросов без ключа.
+	// По умолчанию ключ генерируется, и такие запросы повторяются, а с этой опцией повторяются
+	// только POST и PATCH с ключом, заданным вызывающим
+	DisableIdempotencyKeys bool
+	// Cache - кеш ответов на GET-запросы, nil - кеш выключен. См. NewLRUCache
+	Cache ResponseCache
+	// TenantRateLimit - запросов в минуту для одного тенанта (Request.Tenant), 0 - без отдельного лимита.
+	// Общий RateLimit тенанты в любом случае делят поровну: тенанты с запросами в очереди получают токены
+	// по очереди, а доля тенантов без запросов достается остальным
+	TenantRateLimit int
+	TenantBurst     int // по умолчанию Burst
+	// TenantIdleTimeout - метрики тенанта без запросов дольше этого времени удаляются, и с тем же
+	// интервалом планировщик забывает тенантов с пустой очередью и полным sub-bucket-ом. По умолчанию 10m
+	TenantIdleTimeout time.Duration
 }
 
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// RetryPolicy - правила повторов запроса. Повторяются только безопасные для повтора запросы:
+// GET, HEAD, OPTIONS, PUT и DELETE всегда, POST и PATCH - только с Idempotency-Key. Кроме ответов с кодами
+// из Statuses повторяются попытки, оставшиеся без ответа: ошибка соединения или истекший DefaultTimeout.
+// Нулевые поля берутся из политики клиента.
+type RetryPolicy struct {
+	MaxAttempts int           // всего попыток, включая первую. По умолчанию MaxRetries + 1
+	Statuses    []int         // коды ответа, после которых запрос повторяется. По умолчанию 429, 500, 502, 503, 504
+	BaseBackoff time.Duration // верхняя граница паузы перед первым повтором, по умолчанию 100ms
+	MaxBackoff  time.Duration // по умолчанию 5s
+}
+
+// withDefaults заполняет нулевые поля политики значениями из defaults.
+func (p RetryPolicy) withDefaults(defaults RetryPolicy) RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	if len(p.Statuses) == 0 {
+		p.Statuses = defaults.Statuses
+	}
+	if p.BaseBackoff <= 0 {
+		p.BaseBackoff = defaults.BaseBackoff
+	}
+	if p.MaxBackoff < p.BaseBackoff {
+		p.MaxBackoff = max(defaults.MaxBackoff, p.BaseBackoff)
+	}
+	return p
+}
+
+// backoff - случайная пауза перед попыткой attempt (full jitter): от 0 до BaseBackoff * 2^(attempt-2), но не больше MaxBackoff.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.BaseBackoff
+	for i := 2; i < attempt && ceiling < p.MaxBackoff; i++ {
+		ceiling *= 2
+	}
+	return rand.N(min(ceiling, p.MaxBackoff) + 1)
+}
+
+// OverloadPolicy - поведение Do при заполненной очереди.
+type OverloadPolicy int
+
+const (
+	OverloadBlock      OverloadPolicy = iota // ждать места в очереди, пока не отменен контекст
+	OverloadReject                           // сразу вернуть ErrQueueFull
+	OverloadDropOldest                       // вытеснить самый старый обычный запрос, он получит ErrQueueFull
+)
+
 type Request struct {
-	Method   string
-	Endpoint string
-	Body     []byte
-	Headers  map[string]string
-	Urgent   bool
+	Method         string
+	Endpoint       string
+	Body           []byte
+	Headers        map[string]string
+	Urgent         bool
+	Tenant         string       // тенант, от имени которого идет запрос, для справедливого деления лимита
+	IdempotencyKey string       // отправляется в заголовке Idempotency-Key, одинаковый во всех попытках
+	Retry          *RetryPolicy // nil - политика клиента
 }
 
 type ClientRequest struct {
 	req        Request
 	resultChan chan Result
 	context    context.Context
+	enqueuedAt time.Time
 }
 
 type Response struct {
@@ -69,177 +162,1716 @@ type Result struct {
 	response *Response
 }
 
+var (
+	ErrTooManyRequests = errors.New("Too many requests")
+	ErrServerError     = errors.New("Server error")
+	ErrQueueFull       = errors.New("API Client queue is full")
+	ErrClientClosed    = errors.New("API Client has been closed")
+)
+
+// APIError - ответ сервера с кодом 429 или 5xx. Сам ответ тоже возвращается из запроса,
+// а проверять тип ошибки удобно через errors.Is(err, ErrTooManyRequests) / errors.Is(err, ErrServerError).
+type APIError struct {
+	StatusCode int
+	Body       []byte
+	RetryAfter time.Duration // сколько сервер просит подождать, 0 - сервер не прислал подсказку
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *APIError) Unwrap() error {
+	if e.StatusCode == http.StatusTooManyRequests {
+		return ErrTooManyRequests
+	}
+	return ErrServerError
+}
+
+// transportError - попытка не получила ответа сервера: ошибка соединения или истек DefaultTimeout.
+// Такие попытки повторяются по той же RetryPolicy, что и ответы с кодами из Statuses.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
 type APIClient interface {
 	Do(ctx context.Context, req Request) (*Response, error)
-	Close() error
+	Close(ctx context.Context) error
 }
 
 type APIClientEx struct {
-	controlChan chan struct{}
-	stopChan    chan struct{}
-	urgentChan  chan ClientRequest
-	generalChan chan ClientRequest
-	config      APIClientConfig
-	mu          *sync.RWMutex
-	wg          *sync.WaitGroup
+	ctx       context.Context // отменяется, когда Close перестает ждать завершения запросов
+	cancel    context.CancelFunc
+	limiter   *TokenBucket
+	scheduler *requestScheduler
+	metrics   *clientMetrics
+	work      chan *ClientRequest // запросы, получившие токен, передаются воркерам
+	idle      chan struct{}       // свободные воркеры, dispatch не берет запрос из очереди без свободного воркера
+	config    APIClientConfig
+	closed    bool            // Close уже вызван, новые запросы не принимаются
+	calls     *sync.WaitGroup // вызовы Do в работе
+	mu        *sync.RWMutex
+	wg        *sync.WaitGroup // dispatch и воркеры
 }
 
+var _ APIClient = &APIClientEx{}
+
 func NewApiClient(config APIClientConfig) *APIClientEx {
-	controlChan := make(chan struct{}, config.RateLimit)
-	urgentChan := make(chan ClientRequest, config.RateLimit)
-	generalChan := make(chan ClientRequest, config.RateLimit)
-	stopChan := make(chan struct{})
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.RateLimit <= 0 {
+		config.RateLimit = 100
+	}
+	if config.Burst <= 0 {
+		config.Burst = 1
+	}
+	if config.Clock == nil {
+		config.Clock = realClock{}
+	}
+	if config.UrgentWeight <= 0 {
+		config.UrgentWeight = 4
+	}
+	if config.MaxQueueWait <= 0 {
+		config.MaxQueueWait = 5 * time.Second
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = config.RateLimit
+	}
+	if config.Workers <= 0 {
+		config.Workers = 10
+	}
+	if config.TenantBurst <= 0 {
+		config.TenantBurst = config.Burst
+	}
+	if config.TenantIdleTimeout <= 0 {
+		config.TenantIdleTimeout = 10 * time.Minute
+	}
+	config.RetryPolicy = config.RetryPolicy.withDefaults(RetryPolicy{
+		MaxAttempts: max(config.MaxRetries, 0) + 1,
+		Statuses: []int{
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+		BaseBackoff: 100 * time.Millisecond,
+		MaxBackoff:  5 * time.Second,
+	})
 
-	wg := &sync.WaitGroup{}
+	ctx, cancel := context.WithCancel(context.Background())
+	api := &APIClientEx{
+		ctx:       ctx,
+		cancel:    cancel,
+		limiter:   NewTokenBucket(config.RateLimit, config.Burst, config.Clock),
+		scheduler: newRequestScheduler(config, config.Clock),
+		metrics:   newClientMetrics(config.Clock, config.TenantIdleTimeout),
+		work:      make(chan *ClientRequest, config.Workers),
+		idle:      make(chan struct{}, config.Workers),
+		mu:        &sync.RWMutex{},
+		config:    config,
+		calls:     &sync.WaitGroup{},
+		wg:        &sync.WaitGroup{},
+	}
 
-	wg.Add(1)
-	go func() {
-		ticker := time.NewTicker(60 * time.Second)
-		defer ticker.Stop()
-		defer wg.Done()
-		for {
-			select {
-			case <-stopChan:
-				return
-			case <-ticker.C:
-				for {
-					select {
-					case <-controlChan:
-					default:
-						break
-					}
-				}
-			}
+	api.wg.Add(1 + config.Workers)
+	go api.dispatch()
+	for range config.Workers {
+		api.idle <- struct{}{}
+		go api.worker()
+	}
+
+	return api
+}
+
+func (api *APIClientEx) Do(ctx context.Context, req Request) (*Response, error) {
+	resp, err := api.doCached(ctx, req)
+	api.metrics.recordRequest(req, resp, err)
+	return resp, err
+}
+
+// doCached отвечает на GET-запрос из кеша, пока ответ свежий (Cache-Control: max-age), не тратя токен
+// rate limiter-а. Устаревший ответ с ETag или Last-Modified перепроверяется условным запросом,
+// и на 304 клиент получает тело из кеша.
+func (api *APIClientEx) doCached(ctx context.Context, req Request) (*Response, error) {
+	api.mu.RLock()
+	cache := api.config.Cache
+	baseURL := api.config.BaseURL
+	api.mu.RUnlock()
+
+	if cache == nil || !cacheableRequest(req) {
+		return api.do(ctx, req)
+	}
+	target, err := joinURL(baseURL, req.Endpoint)
+	if err != nil {
+		return api.do(ctx, req)
+	}
+	// тенанты одного клиента не должны получать ответы друг друга
+	key := req.Tenant + " " + target
+
+	now := api.config.Clock.Now()
+	entry, found := cache.Get(key)
+	found = found && varyMatches(entry, req)
+	if found && now.Before(entry.Expires) {
+		api.metrics.recordCache(req, false)
+		return cloneResponse(entry.Response), nil
+	}
+	if found {
+		req = withValidators(req, entry)
+	}
+
+	resp, err := api.do(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+
+	now = api.config.Clock.Now()
+	if found && resp.StatusCode == http.StatusNotModified {
+		api.metrics.recordCache(req, true)
+		expires, storable := cacheExpiry(resp.Headers, now)
+		if !storable {
+			// 304 подтверждает сохраненный ответ, но хранить его дальше сервер запретил
+			cache.Delete(key)
+			return cloneResponse(entry.Response), nil
 		}
-	}()
+		entry.Expires = expires
+		if etag := resp.Headers["Etag"]; etag != "" {
+			entry.ETag = etag
+		}
+		if lastModified := resp.Headers["Last-Modified"]; lastModified != "" {
+			entry.LastModified = lastModified
+		}
+		cache.Set(key, entry)
+		return cloneResponse(entry.Response), nil
+	}
 
-	return &APIClientEx{
-		mu:          &sync.RWMutex{},
-		controlChan: controlChan,
-		generalChan: generalChan,
-		urgentChan:  urgentChan,
-		config:      config,
-		stopChan:    stopChan,
-		wg:          wg,
+	if resp.StatusCode == http.StatusOK {
+		if fresh, ok := newCachedResponse(req, resp, now); ok {
+			cache.Set(key, fresh)
+		} else if found {
+			cache.Delete(key)
+		}
 	}
+	return resp, nil
 }
 
-func (api *APIClientEx) Do(ctx context.Context, req Request) (*Response, error) {
+func (api *APIClientEx) do(ctx context.Context, req Request) (*Response, error) {
 
-	clientRequest := ClientRequest{req: req, context: ctx}
+	clientRequest := &ClientRequest{req: req, context: ctx}
 	clientRequest.resultChan = make(chan Result, 1)
 
-	api.wg.Add(1)
-	defer api.wg.Done()
+	// Add под мьютексом, чтобы не гоняться с calls.Wait в Close
+	api.mu.RLock()
+	if api.closed {
+		api.mu.RUnlock()
+		return nil, ErrClientClosed
+	}
+	api.calls.Add(1)
+	api.mu.RUnlock()
+	defer api.calls.Done()
+
+	if err := api.scheduler.push(ctx, api.ctx.Done(), clientRequest); err != nil {
+		return nil, err
+	}
 
 	select {
-	case <-api.stopChan:
-		return nil, errors.New("API Client has been stopped")
-	default:
-		if req.Urgent {
-			api.urgentChan <- clientRequest
-		} else {
-			api.generalChan <- clientRequest
+	case <-api.ctx.Done():
+		api.scheduler.remove(clientRequest)
+		return nil, ErrClientClosed
+	case <-ctx.Done():
+		if api.scheduler.remove(clientRequest) {
+			return nil, ctx.Err()
 		}
+		// запрос уже отправляется, его попытка прервется по отмене контекста
+		result := <-clientRequest.resultChan
+		return result.response, result.err
+	case result := <-clientRequest.resultChan:
+		return result.response, result.err
 	}
+}
 
-	api.wg.Add(1)
-
-	go api.doReq()
-
+// dispatch выдает запросам из очереди свободного воркера и токен rate limiter-а. Следующий запрос выбирается
+// в момент, когда и воркер, и токен уже есть, поэтому пришедший за время ожидания urgent-запрос обгоняет обычные.
+func (api *APIClientEx) dispatch() {
+	defer api.wg.Done()
+	defer close(api.work)
 	for {
 		select {
-		case <-api.stopChan:
-			return nil, errors.New("API Client has been stopped")
-		case result := <-clientRequest.resultChan:
-			return result.response, result.err
+		case <-api.idle:
+		case <-api.ctx.Done():
+			return
+		}
+		if err := api.scheduler.wait(api.ctx); err != nil {
+			return
+		}
+		waited, err := api.limiter.wait(api.ctx)
+		if err != nil {
+			return
+		}
+		req, retryIn := api.scheduler.pop()
+		if req == nil {
+			// токен не пригодился: запросы в очереди отменили, пока ждали токен,
+			// или у всех тенантов в очереди исчерпан собственный лимит
+			api.limiter.refund()
+			api.idle <- struct{}{}
+			if retryIn > 0 {
+				timer := api.config.Clock.NewTimer(retryIn)
+				select {
+				case <-timer.C():
+				case <-api.scheduler.notify:
+				case <-api.ctx.Done():
+					timer.Stop()
+					return
+				}
+				timer.Stop()
+			}
+			continue
+		}
+		api.metrics.recordQueueTime(req.req, api.config.Clock.Now().Sub(req.enqueuedAt))
+		if waited > 0 {
+			api.metrics.recordRateLimitWait(req.req, waited)
 		}
+		api.work <- req
 	}
 }
 
-func (api *APIClientEx) doReq() {
-
+func (api *APIClientEx) worker() {
 	defer api.wg.Done()
+	for req := range api.work {
+		api.doReq(req)
+		api.idle <- struct{}{}
+	}
+}
 
-	var req ClientRequest
-	var err error
-	var resp *Response
+func (api *APIClientEx) doReq(req *ClientRequest) {
+
+	defer close(req.resultChan)
+
+	resp, err := api.execute(req)
+	if err != nil && api.ctx.Err() != nil {
+		// попытку прервал Close
+		err = ErrClientClosed
+	}
+	req.resultChan <- Result{response: resp, err: err}
+}
 
+// execute выполняет запрос с повторами по RetryPolicy. Токен на первую попытку выдает dispatch,
+// повторные попытки ждут токен сами.
+func (api *APIClientEx) execute(req *ClientRequest) (*Response, error) {
 	api.mu.RLock()
-	timeout := api.config.DefaultTimeout
-	amountOfReauests := api.config.MaxRetries
+	policy := api.config.RetryPolicy
+	generateKeys := !api.config.DisableIdempotencyKeys
 	api.mu.RUnlock()
+	if req.req.Retry != nil {
+		policy = req.req.Retry.withDefaults(policy)
+	}
 
-	ticker := time.NewTicker(timeout)
-	defer ticker.Stop()
+	httpReq, retryable := prepareIdempotency(req.req, generateKeys)
 
-	select {
-	case req = <-api.urgentChan:
+	// запрос прерывается и отменой пользователя, и закрытием клиента
+	ctx, cancel := context.WithCancel(req.context)
+	defer cancel()
+	stop := context.AfterFunc(api.ctx, cancel)
+	defer stop()
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			api.metrics.recordRetry(req.req)
+			// повтор тратит и токен своего тенанта, иначе повторы шумного тенанта обходят его лимит
+			tenantWaited, err := api.scheduler.waitTenant(ctx, req.req.Tenant)
+			if err != nil {
+				return nil, err
+			}
+			waited, err := api.limiter.wait(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if waited += tenantWaited; waited > 0 {
+				api.metrics.recordRateLimitWait(req.req, waited)
+			}
+		}
+		start := api.config.Clock.Now()
+		resp, err := api.processRequestOnServer(ctx, httpReq)
+		api.metrics.recordServerTime(req.req, api.config.Clock.Now().Sub(start))
+		// ответ не пришел - повторяем, если запрос не отменен вызывающим или закрытием клиента
+		var transportErr *transportError
+		failed := errors.As(err, &transportErr) && ctx.Err() == nil ||
+			resp != nil && slices.Contains(policy.Statuses, resp.StatusCode)
+		if !retryable || attempt >= policy.MaxAttempts || !failed {
+			return resp, err
+		}
+
+		// если сервер прислал Retry-After, rate limiter уже на паузе, и следующая попытка подождет в Wait
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			continue
+		}
+
+		timer := api.config.Clock.NewTimer(policy.backoff(attempt + 1))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, err
+		case <-timer.C():
+		}
+	}
+}
+
+// prepareIdempotency определяет, можно ли повторять запрос, и при необходимости добавляет ему Idempotency-Key.
+// Ключ выставляется один раз до первой попытки, поэтому сервер видит все повторы как один запрос.
+func prepareIdempotency(req Request, generateKeys bool) (Request, bool) {
+	key := req.IdempotencyKey
+	for name, value := range req.Headers {
+		if strings.EqualFold(name, idempotencyKeyHeader) && key == "" {
+			key = value
+		}
+	}
+
+	switch strings.ToUpper(req.Method) {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	case http.MethodPost, http.MethodPatch:
+		if key == "" && generateKeys {
+			key = newIdempotencyKey()
+		}
+		if key == "" {
+			return req, false
+		}
 	default:
-		req = <-api.generalChan
+		return req, false
 	}
-	defer close(req.resultChan)
 
+	if key != "" {
+		headers := make(map[string]string, len(req.Headers)+1)
+		for name, value := range req.Headers {
+			if !strings.EqualFold(name, idempotencyKeyHeader) {
+				headers[name] = value
+			}
+		}
+		headers[idempotencyKeyHeader] = key
+		req.Headers = headers
+	}
+	return req, true
+}
+
+// newIdempotencyKey генерирует случайный UUID v4.
+func newIdempotencyKey() string {
+	var uuid [16]byte
+	crand.Read(uuid[:])
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// processRequestOnServer выполняет одну попытку запроса. На попытку отводится DefaultTimeout,
+// ответы 429/5xx возвращаются вместе с *APIError.
+func (api *APIClientEx) processRequestOnServer(ctx context.Context, req Request) (*Response, error) {
+	api.mu.RLock()
+	config := api.config
+	api.mu.RUnlock()
+
+	if config.DefaultTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.DefaultTimeout)
+		defer cancel()
+	}
+
+	target, err := joinURL(config.BaseURL, req.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var body io.Reader
+	if req.Body != nil {
+		body = bytes.NewReader(req.Body)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range req.Headers {
+		httpReq.Header.Set(key, value)
+	}
+
+	httpResp, err := config.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, &transportError{err: err}
+	}
+	defer httpResp.Body.Close()
+
+	// тело читается до отмены контекста попытки, поэтому таймаут распространяется и на него
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, &transportError{err: err}
+	}
+
+	resp := &Response{
+		StatusCode: httpResp.StatusCode,
+		Body:       respBody,
+		Headers:    make(map[string]string, len(httpResp.Header)),
+	}
+	for key, values := range httpResp.Header {
+		resp.Headers[key] = strings.Join(values, ", ")
+	}
+
+	// сервер сам говорит, когда к нему можно вернуться - притормаживаем всех вызывающих разом
+	now := config.Clock.Now()
+	pauseUntil, paused := rateLimitPause(resp, now)
+	if paused {
+		api.limiter.Pause(pauseUntil)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		apiErr := &APIError{StatusCode: resp.StatusCode, Body: respBody}
+		if paused {
+			apiErr.RetryAfter = pauseUntil.Sub(now)
+		}
+		return resp, apiErr
+	}
+	return resp, nil
+}
+
+// rateLimitPause определяет по заголовкам ответа, до какого момента сервер просит не присылать запросы:
+//   - Retry-After (в ответах 429/503) - в секундах или HTTP-датой
+//   - X-RateLimit-Remaining: 0 вместе с X-RateLimit-Reset - в секундах до сброса лимита или unix-временем сброса
+func rateLimitPause(resp *Response, now time.Time) (time.Time, bool) {
+	header := func(key string) string {
+		return strings.TrimSpace(resp.Headers[http.CanonicalHeaderKey(key)])
+	}
+
+	if retryAfter := header("Retry-After"); retryAfter != "" &&
+		(resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			return now.Add(time.Duration(seconds) * time.Second), seconds > 0
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return date, date.After(now)
+		}
+	}
+
+	if header("X-RateLimit-Remaining") != "0" {
+		return time.Time{}, false
+	}
+	reset, err := strconv.ParseInt(header("X-RateLimit-Reset"), 10, 64)
+	if err != nil || reset <= 0 {
+		return time.Time{}, false
+	}
+	// небольшие значения - секунды до сброса, большие - unix-время (как у GitHub API)
+	if reset < 1_000_000_000 {
+		return now.Add(time.Duration(reset) * time.Second), true
+	}
+	until := time.Unix(reset, 0)
+	return until, until.After(now)
+}
+
+// joinURL склеивает BaseURL и Endpoint. Endpoint может содержать query string,
+// а абсолютный URL в Endpoint используется как есть.
+func joinURL(baseURL, endpoint string) (string, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if endpointURL.IsAbs() {
+		return endpoint, nil
+	}
+	if baseURL == "" {
+		return "", errors.New("BaseURL is not set")
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return "", err
+	}
+	if endpoint == "" {
+		return baseURL, nil
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/" + strings.TrimPrefix(endpoint, "/"), nil
+}
+
+// Close перестает принимать новые запросы и ждет, пока запросы из очереди и в работе завершатся.
+// Если ctx отменится раньше, оставшиеся запросы прерываются и получают ErrClientClosed,
+// а Close возвращает ошибку контекста. В любом случае к возврату из Close все горутины клиента завершены.
+func (api *APIClientEx) Close(ctx context.Context) error {
+	api.mu.Lock()
+	if api.closed {
+		api.mu.Unlock()
+		return ErrClientClosed
+	}
+	api.closed = true
+	api.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		api.calls.Wait()
+		close(drained)
+	}()
+
+	var err error
 	select {
-	case api.controlChan <- struct{}{}:
-		resp, err = api.processRequestOnServer(req.req)
-		if err == nil {
-			req.resultChan <- Result{response: resp, err: err}
-			return
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	api.cancel()
+	<-drained
+	api.wg.Wait()
+	return err
+}
+
+// Clock - источник времени для rate limiter-а.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) ClockTimer
+}
+
+// ClockTimer - таймер Clock. Stop нужно вызывать, если ожидание прервано, иначе таймер FakeClock
+// так и останется в списке ожидающих.
+type ClockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) ClockTimer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.timer.C }
+
+func (t realTimer) Stop() bool { return t.timer.Stop() }
+
+// FakeClock - ручные часы для детерминированных тестов: время идет только при вызове Advance.
+type FakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	mu     *sync.Mutex
+}
+
+type fakeTimer struct {
+	at    time.Time
+	ch    chan time.Time
+	clock *FakeClock
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+// Stop убирает таймер из списка ожидающих. false - таймер уже сработал.
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	idx := slices.Index(t.clock.timers, t)
+	if idx == -1 {
+		return false
+	}
+	t.clock.timers = slices.Delete(t.clock.timers, idx, idx+1)
+	return true
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now, mu: &sync.Mutex{}}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) ClockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{at: c.now.Add(d), ch: make(chan time.Time, 1), clock: c}
+	if d <= 0 {
+		timer.ch <- c.now
+		return timer
+	}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance переводит часы вперед и срабатывает таймеры, время которых наступило.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
 		}
-		if (resp.StatusCode == 429 || resp.StatusCode/100 == 5) && err != nil {
-			amountOfReauests--
-		} else {
-			req.resultChan <- Result{response: resp, err: err}
-			return
+		timer.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// Waiters возвращает количество таймеров, которые еще не сработали. В тестах по нему удобно дождаться,
+// пока горутина заснет в Wait, прежде чем двигать часы.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// TokenBucket пополняется непрерывно: rate токенов в минуту, но не больше burst.
+// Wait резервирует токен сразу, поэтому ожидающие вызовы получают токены в порядке очереди
+// и каждый ждет ровно до момента, когда его токен накопится.
+// Pause останавливает выдачу токенов всем вызовам, например по Retry-After от сервера.
+type TokenBucket struct {
+	rate        float64 // токенов в наносекунду
+	burst       float64
+	tokens      float64 // отрицательное значение - токены, уже зарезервированные ожидающими вызовами
+	last        time.Time
+	pausedUntil time.Time     // до этого момента токены не выдаются и не накапливаются
+	paused      time.Duration // сумма всех пауз: на сколько Pause сдвинули токены, уже зарезервированные в wait
+	clock       Clock
+	mu          *sync.Mutex
+}
+
+func NewTokenBucket(ratePerMinute, burst int, clock Clock) *TokenBucket {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &TokenBucket{
+		rate:   float64(ratePerMinute) / float64(time.Minute),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clock.Now(),
+		clock:  clock,
+		mu:     &sync.Mutex{},
+	}
+}
+
+// refill начисляет токены за прошедшее время, не считая паузы. Вызывать под мьютексом.
+func (tb *TokenBucket) refill() time.Time {
+	now := tb.clock.Now()
+	if elapsed := now.Sub(later(tb.last, tb.pausedUntil)); elapsed > 0 {
+		tb.tokens = min(tb.burst, tb.tokens+float64(elapsed)*tb.rate)
+	}
+	tb.last = now
+	return now
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Pause останавливает выдачу токенов до until. Накопленный запас сгорает, чтобы после паузы
+// клиент не отправил серверу сразу burst запросов, а вызовы, которые уже ждут токен в Wait,
+// получат его на время паузы позже - по-прежнему по одному с интервалом пополнения.
+// Более короткая пауза не сокращает уже действующую.
+func (tb *TokenBucket) Pause(until time.Time) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.refill()
+	if until.After(tb.pausedUntil) {
+		tb.paused += until.Sub(later(now, tb.pausedUntil))
+		tb.pausedUntil = until
+		tb.tokens = min(tb.tokens, 0)
+	}
+}
+
+// ready проверяет, есть ли токен, не забирая его. Если токена нет, возвращает, через сколько он появится.
+func (tb *TokenBucket) ready() (bool, time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.refill()
+	if tb.tokens >= 1 && !now.Before(tb.pausedUntil) {
+		return true, 0
+	}
+	return false, max(tb.pausedUntil.Sub(now), 0) + time.Duration((1-tb.tokens)/tb.rate)
+}
+
+// full - bucket полностью пополнен, ожидающих токен нет.
+func (tb *TokenBucket) full() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill()
+	return tb.tokens >= tb.burst
+}
+
+// refund возвращает токен, который забрали, но не использовали.
+func (tb *TokenBucket) refund() {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill()
+	tb.tokens = min(tb.burst, tb.tokens+1)
+}
+
+// Allow забирает токен, если он есть, не дожидаясь пополнения.
+func (tb *TokenBucket) Allow() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.refill()
+	if tb.tokens < 1 || now.Before(tb.pausedUntil) {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// Wait ждет токен. Если контекст отменится раньше или дедлайн наступит до появления токена,
+// резерв возвращается в bucket и Wait сразу возвращает ошибку.
+func (tb *TokenBucket) Wait(ctx context.Context) error {
+	_, err := tb.wait(ctx)
+	return err
+}
+
+// wait ждет токен и возвращает, сколько пришлось ждать.
+func (tb *TokenBucket) wait(ctx context.Context) (time.Duration, error) {
+	tb.mu.Lock()
+	now := tb.refill()
+	tb.tokens--
+	delay := max(tb.pausedUntil.Sub(now), 0)
+	if tb.tokens < 0 {
+		delay += time.Duration(-tb.tokens / tb.rate)
+	}
+	if delay <= 0 {
+		tb.mu.Unlock()
+		return 0, nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Sub(now) < delay {
+		tb.tokens++
+		tb.mu.Unlock()
+		return 0, fmt.Errorf("Rate limit wait exceeds context deadline: %w", context.DeadlineExceeded)
+	}
+	// момент, когда накопится зарезервированный токен, без учета будущих пауз
+	readyAt := now.Add(delay)
+	pausedBefore := tb.paused
+	tb.mu.Unlock()
+
+	for {
+		timer := tb.clock.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			tb.mu.Lock()
+			tb.tokens++
+			tb.mu.Unlock()
+			return 0, ctx.Err()
 		}
-	default:
+
+		// пока вызов ждал, сервер мог попросить подождать еще: токен сдвигается на длину новых пауз
+		tb.mu.Lock()
+		current := tb.clock.Now()
+		delay = readyAt.Add(tb.paused - pausedBefore).Sub(current)
+		tb.mu.Unlock()
+		if delay <= 0 {
+			return current.Sub(now), nil
+		}
+	}
+}
+
+// requestScheduler - очередь запросов с приоритетом. Urgent-запросы идут первыми, но после UrgentWeight
+// urgent-запросов подряд пропускается один обычный (взвешенное разделение 4:1 по умолчанию).
+// Обычный запрос, который прождал MaxQueueWait, отправляется вне очереди, поэтому обычные запросы
+// не голодают даже при постоянном потоке urgent-запросов.
+//
+// Внутри приоритета тенанты обслуживаются по кругу: следующим идет самый старый запрос тенанта,
+// который дольше всех не получал токен. Так каждый тенант с запросами в очереди получает равную долю
+// общего лимита, сколько бы запросов ни прислал. Если задан TenantRateLimit, у каждого тенанта есть
+// свой sub-bucket, и тенант, исчерпавший его, пропускает очередь.
+type requestScheduler struct {
+	urgent       []*ClientRequest
+	normal       []*ClientRequest
+	urgentWeight int
+	maxWait      time.Duration
+	capacity     int
+	policy       OverloadPolicy
+	tenants      map[string]*tenantState // только тенанты с запросами в очереди или неполным sub-bucket-ом
+	tenantRate   int
+	tenantBurst  int
+	sweepEvery   time.Duration // как часто удаляются тенанты, которым sub-bucket больше не нужен
+	sweepAt      time.Time
+	served       uint64        // счетчик выдач, по нему определяется очередность тенантов
+	urgentInRow  int           // сколько urgent-запросов выдано подряд
+	notify       chan struct{} // сигнал, что в очереди появились запросы
+	space        chan struct{} // закрывается и пересоздается, когда в очереди освобождается место
+	clock        Clock
+	mu           *sync.Mutex
+}
+
+func newRequestScheduler(config APIClientConfig, clock Clock) *requestScheduler {
+	return &requestScheduler{
+		urgentWeight: config.UrgentWeight,
+		maxWait:      config.MaxQueueWait,
+		capacity:     config.QueueSize,
+		policy:       config.OverloadPolicy,
+		tenants:      make(map[string]*tenantState),
+		tenantRate:   config.TenantRateLimit,
+		tenantBurst:  config.TenantBurst,
+		sweepEvery:   config.TenantIdleTimeout,
+		sweepAt:      clock.Now().Add(config.TenantIdleTimeout),
+		notify:       make(chan struct{}, 1),
+		space:        make(chan struct{}),
+		clock:        clock,
+		mu:           &sync.Mutex{},
 	}
+}
 
+// push ставит запрос в очередь. Если очередь заполнена, поведение зависит от OverloadPolicy.
+func (s *requestScheduler) push(ctx context.Context, stop <-chan struct{}, req *ClientRequest) error {
 	for {
+		s.mu.Lock()
+		if len(s.urgent)+len(s.normal) < s.capacity || s.dropOldest() {
+			req.enqueuedAt = s.clock.Now()
+			if req.req.Urgent {
+				s.urgent = append(s.urgent, req)
+			} else {
+				s.normal = append(s.normal, req)
+			}
+			s.tenant(req.req.Tenant).queued++
+			s.signal()
+			s.mu.Unlock()
+			return nil
+		}
+		if s.policy != OverloadBlock {
+			s.mu.Unlock()
+			return ErrQueueFull
+		}
+		space := s.space
+		s.mu.Unlock()
+
 		select {
-		case <-api.stopChan:
-			req.resultChan <- Result{response: resp, err: err}
-			return
-		case <-req.context.Done():
-			req.resultChan <- Result{response: resp, err: err}
-			return
-		case <-ticker.C:
-			select {
-			case api.controlChan <- struct{}{}:
-				resp, err = api.processRequestOnServer(req.req)
-				if amountOfReauests == 0 {
-					req.resultChan <- Result{response: resp, err: err}
-					return
-				}
-				if err == nil {
-					req.resultChan <- Result{response: resp, err: err}
-					return
-				}
-				if (resp.StatusCode == 429 || resp.StatusCode/100 == 5) && err != nil {
-					timeout *= 2
-					ticker.Reset(timeout)
-					amountOfReauests--
-				} else {
-					req.resultChan <- Result{response: resp, err: err}
-					return
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stop:
+			return ErrClientClosed
+		}
+	}
+}
+
+// dropOldest освобождает место по политике OverloadDropOldest: вытесняет самый старый обычный запрос.
+// Urgent-запросы не вытесняются никогда. Вызывать под мьютексом.
+func (s *requestScheduler) dropOldest() bool {
+	if s.policy != OverloadDropOldest || len(s.normal) == 0 {
+		return false
+	}
+	var dropped *ClientRequest
+	dropped, s.normal = s.normal[0], s.normal[1:]
+	s.untrack(dropped)
+	dropped.resultChan <- Result{err: ErrQueueFull}
+	return true
+}
+
+type tenantState struct {
+	bucket     *TokenBucket // sub-bucket тенанта, nil - без отдельного лимита
+	lastServed uint64       // значение served при последней выдаче тенанту
+	queued     int          // запросов тенанта в очереди
+	waiting    int          // повторов тенанта, ждущих токен sub-bucket-а
+}
+
+// idle - состояние тенанта можно забыть: запросов в очереди и ожидающих повторов нет, а sub-bucket полный.
+func (state *tenantState) idle() bool {
+	return state.queued == 0 && state.waiting == 0 && (state.bucket == nil || state.bucket.full())
+}
+
+// tenant возвращает состояние тенанта, создавая его при первом запросе. Вызывать под мьютексом.
+func (s *requestScheduler) tenant(name string) *tenantState {
+	state, exists := s.tenants[name]
+	if !exists {
+		state = &tenantState{}
+		if s.tenantRate > 0 {
+			state.bucket = NewTokenBucket(s.tenantRate, s.tenantBurst, s.clock)
+		}
+		s.tenants[name] = state
+	}
+	return state
+}
+
+// untrack учитывает, что запрос ушел из очереди. Состояние тенанта удаляется, когда в нем не осталось
+// ничего, что нужно помнить. Вызывать под мьютексом.
+func (s *requestScheduler) untrack(req *ClientRequest) {
+	state := s.tenants[req.req.Tenant]
+	state.queued--
+	if state.idle() {
+		delete(s.tenants, req.req.Tenant)
+	}
+}
+
+// sweep раз в sweepEvery удаляет тенантов, чей sub-bucket пополнился уже после ухода последнего запроса:
+// сразу после выдачи токена bucket не полный, и untrack такого тенанта не удаляет. Вызывать под мьютексом.
+func (s *requestScheduler) sweep() {
+	now := s.clock.Now()
+	if now.Before(s.sweepAt) {
+		return
+	}
+	s.sweepAt = now.Add(s.sweepEvery)
+	for name, state := range s.tenants {
+		if state.idle() {
+			delete(s.tenants, name)
+		}
+	}
+}
+
+// waitTenant ждет токен sub-bucket-а тенанта для повторной попытки запроса и возвращает, сколько пришлось ждать.
+// Без TenantRateLimit возвращается сразу.
+func (s *requestScheduler) waitTenant(ctx context.Context, name string) (time.Duration, error) {
+	if s.tenantRate <= 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	state := s.tenant(name)
+	state.waiting++
+	s.mu.Unlock()
+
+	waited, err := state.bucket.wait(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state.waiting--
+	if state.idle() {
+		delete(s.tenants, name)
+	}
+	return waited, err
+}
+
+// next выбирает в очереди запрос тенанта, который дольше всех не получал токен, среди тенантов
+// с неисчерпанным sub-bucket-ом. Возвращает -1, если таких нет, и через сколько освободится ближайший
+// sub-bucket. Вызывать под мьютексом.
+func (s *requestScheduler) next(queue []*ClientRequest) (int, time.Duration) {
+	chosen := -1
+	var retryIn time.Duration
+	checked := make(map[string]bool)
+	for idx, req := range queue {
+		state := s.tenants[req.req.Tenant]
+		eligible, seen := checked[req.req.Tenant]
+		if !seen {
+			eligible = true
+			if state.bucket != nil {
+				var wait time.Duration
+				eligible, wait = state.bucket.ready()
+				if !eligible && (retryIn == 0 || wait < retryIn) {
+					retryIn = wait
 				}
-			default:
 			}
+			checked[req.req.Tenant] = eligible
+		}
+		if eligible && (chosen == -1 || state.lastServed < s.tenants[queue[chosen].req.Tenant].lastServed) {
+			chosen = idx
 		}
 	}
+	return chosen, retryIn
 }
 
-func (api *APIClientEx) processRequestOnServer(req Request) (*Response, error) {
-	// process request
-	return &Response{}, nil
+// freed будит вызовы, которые ждут места в очереди. Вызывать под мьютексом.
+func (s *requestScheduler) freed() {
+	close(s.space)
+	s.space = make(chan struct{})
 }
 
-func (api *APIClientEx) Close() error {
-	close(api.stopChan)
-	api.wg.Wait()
-	close(api.controlChan)
-	close(api.urgentChan)
-	close(api.generalChan)
-	return nil
+// remove убирает запрос из очереди. Возвращает false, если запрос уже выдан на отправку.
+func (s *requestScheduler) remove(req *ClientRequest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue := &s.normal
+	if req.req.Urgent {
+		queue = &s.urgent
+	}
+	idx := slices.Index(*queue, req)
+	if idx == -1 {
+		return false
+	}
+	*queue = slices.Delete(*queue, idx, idx+1)
+	s.untrack(req)
+	s.freed()
+	return true
+}
+
+// pop выбирает следующий запрос. nil - очередь пуста или все тенанты в очереди исчерпали свои sub-bucket-ы,
+// тогда второе значение - через сколько у кого-то из них появится токен.
+func (s *requestScheduler) pop() (*ClientRequest, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+
+	var req *ClientRequest
+	var state *tenantState
+	for req == nil {
+		urgentIdx, urgentRetry := s.next(s.urgent)
+		normalIdx, normalRetry := s.next(s.normal)
+		// самый старый обычный запрос отправляется вне очереди, если его тенант не исчерпал свой лимит
+		aged := len(s.normal) > 0 && s.clock.Now().Sub(s.normal[0].enqueuedAt) >= s.maxWait
+		if aged && s.tenants[s.normal[0].req.Tenant].bucket != nil {
+			aged, _ = s.tenants[s.normal[0].req.Tenant].bucket.ready()
+		}
+
+		queue, idx := &s.normal, 0
+		switch {
+		case aged:
+		case urgentIdx != -1 && (normalIdx == -1 || s.urgentInRow < s.urgentWeight):
+			queue, idx = &s.urgent, urgentIdx
+		case normalIdx != -1:
+			idx = normalIdx
+		default:
+			retryIn := urgentRetry
+			if retryIn == 0 || (normalRetry > 0 && normalRetry < retryIn) {
+				retryIn = normalRetry
+			}
+			return nil, retryIn
+		}
+
+		// sub-bucket проверялся без своего мьютекса, и токен мог забрать повтор этого тенанта из waitTenant.
+		// Тогда запрос остается в очереди, а выбор повторяется уже без исчерпавшего лимит тенанта
+		state = s.tenants[(*queue)[idx].req.Tenant]
+		if state.bucket != nil && !state.bucket.Allow() {
+			continue
+		}
+		req = (*queue)[idx]
+		*queue = slices.Delete(*queue, idx, idx+1)
+		if queue == &s.urgent {
+			s.urgentInRow++
+		} else {
+			s.urgentInRow = 0
+		}
+	}
+
+	s.served++
+	state.lastServed = s.served
+	s.untrack(req)
+
+	s.freed()
+	if len(s.urgent)+len(s.normal) > 0 {
+		s.signal()
+	}
+	return req, 0
+}
+
+// wait ждет, пока в очереди появится хотя бы один запрос.
+func (s *requestScheduler) wait(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		pending := len(s.urgent) + len(s.normal)
+		s.mu.Unlock()
+		if pending > 0 {
+			return nil
+		}
+
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// depth возвращает количество urgent и обычных запросов в очереди и количество запросов каждого тенанта.
+func (s *requestScheduler) depth() (int, int, map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tenants := make(map[string]int, len(s.tenants))
+	for name, state := range s.tenants {
+		if state.queued > 0 {
+			tenants[name] = state.queued
+		}
+	}
+	return len(s.urgent), len(s.normal), tenants
+}
+
+// signal будит ожидающего в wait. Вызывать под мьютексом.
+func (s *requestScheduler) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// границы бакетов гистограмм latency в секундах
+var apiLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type APIHistogram struct {
+	Bounds []float64 `json:"bounds"` // верхние границы бакетов в секундах
+	Counts []uint64  `json:"counts"` // количество замеров в каждом бакете, последний - +Inf
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+// APIEndpointMetrics - метрики запросов к одному endpoint-у с одним приоритетом.
+type APIEndpointMetrics struct {
+	Endpoint         string            `json:"endpoint"` // путь без query string
+	Priority         string            `json:"priority"` // urgent или normal
+	Requests         uint64            `json:"requests"` // завершенные вызовы Do
+	Retries          uint64            `json:"retries"`
+	Errors           map[string]uint64 `json:"errors"`           // по классу: 4xx, 5xx, network, canceled, queue_full
+	RateLimitWaits   uint64            `json:"rate_limit_waits"` // попытки, которые ждали токен
+	RateLimitWaited  float64           `json:"rate_limit_waited_seconds"`
+	CacheHits        uint64            `json:"cache_hits"`        // ответы из кеша без запроса к серверу
+	CacheRevalidated uint64            `json:"cache_revalidated"` // ответы из кеша после 304
+	QueueTime        APIHistogram      `json:"queue_time"`        // от постановки в очередь до выдачи токена
+	ServerTime       APIHistogram      `json:"server_time"`       // время одной попытки запроса к серверу
+}
+
+// APITenantMetrics - метрики запросов одного тенанта.
+type APITenantMetrics struct {
+	Tenant     string  `json:"tenant"`
+	Requests   uint64  `json:"requests"` // завершенные вызовы Do
+	Errors     uint64  `json:"errors"`
+	Dispatched uint64  `json:"dispatched"`         // запросы, получившие токен
+	QueueTime  float64 `json:"queue_time_seconds"` // суммарное время ожидания токена
+	QueueDepth int     `json:"queue_depth"`
+}
+
+type APIClientSnapshot struct {
+	Endpoints  []APIEndpointMetrics `json:"endpoints"`
+	Tenants    []APITenantMetrics   `json:"tenants"`
+	QueueDepth map[string]int       `json:"queue_depth"` // по приоритету
+}
+
+type endpointKey struct {
+	endpoint string
+	priority string
+}
+
+type endpointMetrics struct {
+	requests         uint64
+	retries          uint64
+	errors           map[string]uint64
+	rateLimitWaits   uint64
+	rateLimitWaited  float64
+	cacheHits        uint64
+	cacheRevalidated uint64
+	queueTime        []uint64
+	queueTimeSum     float64
+	serverTime       []uint64
+	serverTimeSum    float64
+}
+
+type tenantMetrics struct {
+	requests   uint64
+	errors     uint64
+	dispatched uint64
+	queueTime  float64
+	lastSeen   time.Time // последнее обновление метрик тенанта
+}
+
+type clientMetrics struct {
+	endpoints   map[endpointKey]*endpointMetrics
+	tenants     map[string]*tenantMetrics
+	idleTimeout time.Duration // метрики тенанта без обновлений дольше этого времени удаляются
+	sweepAt     time.Time
+	clock       Clock
+	mu          *sync.Mutex
+}
+
+func newClientMetrics(clock Clock, idleTimeout time.Duration) *clientMetrics {
+	return &clientMetrics{
+		endpoints:   make(map[endpointKey]*endpointMetrics),
+		tenants:     make(map[string]*tenantMetrics),
+		idleTimeout: idleTimeout,
+		sweepAt:     clock.Now().Add(idleTimeout),
+		clock:       clock,
+		mu:          &sync.Mutex{},
+	}
+}
+
+// tenant возвращает метрики тенанта запроса, создавая их при первом обращении. Заодно раз в idleTimeout
+// удаляет метрики тенантов, которые перестали присылать запросы. Вызывать под мьютексом.
+func (m *clientMetrics) tenant(req Request) *tenantMetrics {
+	now := m.clock.Now()
+	if !now.Before(m.sweepAt) {
+		m.sweepAt = now.Add(m.idleTimeout)
+		for name, tm := range m.tenants {
+			if now.Sub(tm.lastSeen) >= m.idleTimeout {
+				delete(m.tenants, name)
+			}
+		}
+	}
+
+	tm, exists := m.tenants[req.Tenant]
+	if !exists {
+		tm = &tenantMetrics{}
+		m.tenants[req.Tenant] = tm
+	}
+	tm.lastSeen = now
+	return tm
+}
+
+func priority(req Request) string {
+	if req.Urgent {
+		return "urgent"
+	}
+	return "normal"
+}
+
+// endpoint возвращает метрики endpoint-а запроса, создавая их при первом обращении. Вызывать под мьютексом.
+func (m *clientMetrics) endpoint(req Request) *endpointMetrics {
+	path, _, _ := strings.Cut(req.Endpoint, "?")
+	key := endpointKey{endpoint: path, priority: priority(req)}
+	em, exists := m.endpoints[key]
+	if !exists {
+		em = &endpointMetrics{
+			errors:     make(map[string]uint64),
+			queueTime:  make([]uint64, len(apiLatencyBuckets)+1),
+			serverTime: make([]uint64, len(apiLatencyBuckets)+1),
+		}
+		m.endpoints[key] = em
+	}
+	return em
+}
+
+// errorClass - класс результата запроса для метрик, пустая строка - успешный ответ.
+func errorClass(resp *Response, err error) string {
+	switch {
+	case resp != nil && resp.StatusCode >= 500:
+		return "5xx"
+	case resp != nil && resp.StatusCode >= 400:
+		return "4xx"
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrQueueFull):
+		return "queue_full"
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	}
+	return "network"
+}
+
+func (m *clientMetrics) recordRequest(req Request, resp *Response, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	em := m.endpoint(req)
+	tm := m.tenant(req)
+	em.requests++
+	tm.requests++
+	if class := errorClass(resp, err); class != "" {
+		em.errors[class]++
+		tm.errors++
+	}
+}
+
+func (m *clientMetrics) recordCache(req Request, revalidated bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	em := m.endpoint(req)
+	if revalidated {
+		em.cacheRevalidated++
+	} else {
+		em.cacheHits++
+	}
+}
+
+func (m *clientMetrics) recordRetry(req Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.endpoint(req).retries++
+}
+
+func (m *clientMetrics) recordRateLimitWait(req Request, waited time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	em := m.endpoint(req)
+	em.rateLimitWaits++
+	em.rateLimitWaited += waited.Seconds()
+}
+
+func (m *clientMetrics) recordQueueTime(req Request, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	em := m.endpoint(req)
+	em.queueTimeSum += observe(em.queueTime, latency)
+	tm := m.tenant(req)
+	tm.dispatched++
+	tm.queueTime += latency.Seconds()
+}
+
+func (m *clientMetrics) recordServerTime(req Request, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	em := m.endpoint(req)
+	em.serverTimeSum += observe(em.serverTime, latency)
+}
+
+// observe добавляет замер в бакеты гистограммы и возвращает его в секундах.
+func observe(counts []uint64, latency time.Duration) float64 {
+	seconds := latency.Seconds()
+	bucket, _ := slices.BinarySearch(apiLatencyBuckets, seconds)
+	counts[bucket]++
+	return seconds
+}
+
+func histogram(counts []uint64, sum float64) APIHistogram {
+	var count uint64
+	for _, c := range counts {
+		count += c
+	}
+	return APIHistogram{
+		Bounds: slices.Clone(apiLatencyBuckets),
+		Counts: slices.Clone(counts),
+		Sum:    sum,
+		Count:  count,
+	}
+}
+
+func (m *clientMetrics) snapshot() []APIEndpointMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	endpoints := make([]APIEndpointMetrics, 0, len(m.endpoints))
+	for key, em := range m.endpoints {
+		errorsByClass := make(map[string]uint64, len(em.errors))
+		for class, amount := range em.errors {
+			errorsByClass[class] = amount
+		}
+		endpoints = append(endpoints, APIEndpointMetrics{
+			Endpoint:         key.endpoint,
+			Priority:         key.priority,
+			Requests:         em.requests,
+			Retries:          em.retries,
+			Errors:           errorsByClass,
+			RateLimitWaits:   em.rateLimitWaits,
+			RateLimitWaited:  em.rateLimitWaited,
+			CacheHits:        em.cacheHits,
+			CacheRevalidated: em.cacheRevalidated,
+			QueueTime:        histogram(em.queueTime, em.queueTimeSum),
+			ServerTime:       histogram(em.serverTime, em.serverTimeSum),
+		})
+	}
+	slices.SortFunc(endpoints, func(a, b APIEndpointMetrics) int {
+		return cmp.Or(strings.Compare(a.Endpoint, b.Endpoint), strings.Compare(a.Priority, b.Priority))
+	})
+	return endpoints
+}
+
+func (m *clientMetrics) tenantsSnapshot(queued map[string]int) []APITenantMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tenants := make([]APITenantMetrics, 0, len(m.tenants))
+	for name, tm := range m.tenants {
+		tenants = append(tenants, APITenantMetrics{
+			Tenant:     name,
+			Requests:   tm.requests,
+			Errors:     tm.errors,
+			Dispatched: tm.dispatched,
+			QueueTime:  tm.queueTime,
+			QueueDepth: queued[name],
+		})
+	}
+	slices.SortFunc(tenants, func(a, b APITenantMetrics) int { return strings.Compare(a.Tenant, b.Tenant) })
+	return tenants
+}
+
+func (api *APIClientEx) Metrics() APIClientSnapshot {
+	urgent, normal, tenants := api.scheduler.depth()
+	return APIClientSnapshot{
+		Endpoints:  api.metrics.snapshot(),
+		Tenants:    api.metrics.tenantsSnapshot(tenants),
+		QueueDepth: map[string]int{"urgent": urgent, "normal": normal},
+	}
+}
+
+// MetricsHandler отдает метрики клиента в текстовом формате Prometheus.
+func (api *APIClientEx) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeAPIClientMetrics(w, api.Metrics())
+	})
+}
+
+func writeAPIClientMetrics(w io.Writer, snapshot APIClientSnapshot) {
+	labels := func(em APIEndpointMetrics) string {
+		return fmt.Sprintf("endpoint=%q,priority=%q", em.Endpoint, em.Priority)
+	}
+
+	fmt.Fprintln(w, "# HELP api_client_requests_total Number of finished API client calls.")
+	fmt.Fprintln(w, "# TYPE api_client_requests_total counter")
+	for _, em := range snapshot.Endpoints {
+		fmt.Fprintf(w, "api_client_requests_total{%s} %d\n", labels(em), em.Requests)
+	}
+
+	fmt.Fprintln(w, "# HELP api_client_retries_total Number of retried attempts.")
+	fmt.Fprintln(w, "# TYPE api_client_retries_total counter")
+	for _, em := range snapshot.Endpoints {
+		fmt.Fprintf(w, "api_client_retries_total{%s} %d\n", labels(em), em.Retries)
+	}
+
+	fmt.Fprintln(w, "# HELP api_client_errors_total Number of failed calls, by error class.")
+	fmt.Fprintln(w, "# TYPE api_client_errors_total counter")
+	for _, em := range snapshot.Endpoints {
+		classes := slices.Sorted(maps.Keys(em.Errors))
+		for _, class := range classes {
+			fmt.Fprintf(w, "api_client_errors_total{%s,class=%q} %d\n", labels(em), class, em.Errors[class])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP api_client_cache_responses_total Number of responses served from the cache, by source.")
+	fmt.Fprintln(w, "# TYPE api_client_cache_responses_total counter")
+	for _, em := range snapshot.Endpoints {
+		fmt.Fprintf(w, "api_client_cache_responses_total{%s,source=\"fresh\"} %d\n", labels(em), em.CacheHits)
+		fmt.Fprintf(w, "api_client_cache_responses_total{%s,source=\"revalidated\"} %d\n", labels(em), em.CacheRevalidated)
+	}
+
+	fmt.Fprintln(w, "# HELP api_client_rate_limit_waits_total Number of attempts that waited for a rate limit token.")
+	fmt.Fprintln(w, "# TYPE api_client_rate_limit_waits_total counter")
+	for _, em := range snapshot.Endpoints {
+		fmt.Fprintf(w, "api_client_rate_limit_waits_total{%s} %d\n", labels(em), em.RateLimitWaits)
+	}
+
+	fmt.Fprintln(w, "# HELP api_client_rate_limit_wait_seconds_total Time spent waiting for rate limit tokens.")
+	fmt.Fprintln(w, "# TYPE api_client_rate_limit_wait_seconds_total counter")
+	for _, em := range snapshot.Endpoints {
+		fmt.Fprintf(w, "api_client_rate_limit_wait_seconds_total{%s} %g\n", labels(em), em.RateLimitWaited)
+	}
+
+	writeHistogram := func(name, help string, get func(APIEndpointMetrics) APIHistogram) {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		for _, em := range snapshot.Endpoints {
+			h := get(em)
+			var cumulative uint64
+			for idx, bound := range h.Bounds {
+				cumulative += h.Counts[idx]
+				fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, labels(em), fmt.Sprint(bound), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels(em), h.Count)
+			fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels(em), h.Sum)
+			fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels(em), h.Count)
+		}
+	}
+	writeHistogram("api_client_queue_time_seconds", "Time from enqueueing a call to getting a rate limit token.",
+		func(em APIEndpointMetrics) APIHistogram { return em.QueueTime })
+	writeHistogram("api_client_server_time_seconds", "Duration of a single attempt to the server.",
+		func(em APIEndpointMetrics) APIHistogram { return em.ServerTime })
+
+	fmt.Fprintln(w, "# HELP api_client_queue_depth Number of calls waiting in the queue.")
+	fmt.Fprintln(w, "# TYPE api_client_queue_depth gauge")
+	for _, prio := range []string{"urgent", "normal"} {
+		fmt.Fprintf(w, "api_client_queue_depth{priority=%q} %d\n", prio, snapshot.QueueDepth[prio])
+	}
+
+	fmt.Fprintln(w, "# HELP api_client_tenant_requests_total Number of finished calls, by tenant.")
+	fmt.Fprintln(w, "# TYPE api_client_tenant_requests_total counter")
+	for _, tm := range snapshot.Tenants {
+		fmt.Fprintf(w, "api_client_tenant_requests_total{tenant=%q} %d\n", tm.Tenant, tm.Requests)
+	}
+
+	fmt.Fprintln(w, "# HELP api_client_tenant_errors_total Number of failed calls, by tenant.")
+	fmt.Fprintln(w, "# TYPE api_client_tenant_errors_total counter")
+	for _, tm := range snapshot.Tenants {
+		fmt.Fprintf(w, "api_client_tenant_errors_total{tenant=%q} %d\n", tm.Tenant, tm.Errors)
+	}
+
+	fmt.Fprintln(w, "# HELP api_client_tenant_dispatched_total Number of calls that got a rate limit token, by tenant.")
+	fmt.Fprintln(w, "# TYPE api_client_tenant_dispatched_total counter")
+	for _, tm := range snapshot.Tenants {
+		fmt.Fprintf(w, "api_client_tenant_dispatched_total{tenant=%q} %d\n", tm.Tenant, tm.Dispatched)
+	}
+
+	fmt.Fprintln(w, "# HELP api_client_tenant_queue_time_seconds_total Time spent in the queue, by tenant.")
+	fmt.Fprintln(w, "# TYPE api_client_tenant_queue_time_seconds_total counter")
+	for _, tm := range snapshot.Tenants {
+		fmt.Fprintf(w, "api_client_tenant_queue_time_seconds_total{tenant=%q} %g\n", tm.Tenant, tm.QueueTime)
+	}
+
+	fmt.Fprintln(w, "# HELP api_client_tenant_queue_depth Number of calls waiting in the queue, by tenant.")
+	fmt.Fprintln(w, "# TYPE api_client_tenant_queue_depth gauge")
+	for _, tm := range snapshot.Tenants {
+		fmt.Fprintf(w, "api_client_tenant_queue_depth{tenant=%q} %d\n", tm.Tenant, tm.QueueDepth)
+	}
+}
+
+// CachedResponse - ответ в кеше вместе с данными для перепроверки.
+type CachedResponse struct {
+	Response     *Response
+	ETag         string
+	LastModified string
+	Expires      time.Time         // до этого момента ответ отдается без запроса к серверу
+	Vary         map[string]string // заголовки запроса из Vary ответа и их значения, ответ подходит только запросам с теми же значениями
+}
+
+// ResponseCache - хранилище кеша ответов. Ключ - тенант и полный URL запроса.
+type ResponseCache interface {
+	Get(key string) (CachedResponse, bool)
+	Set(key string, entry CachedResponse)
+	Delete(key string)
+}
+
+// cacheableRequest - кешируются только GET-запросы без собственных условных заголовков:
+// если вызывающий сам перепроверяет ответ, он ждет 304, а не тело из кеша.
+// Запросы с Authorization не кешируются: ответ на них предназначен только этому пользователю.
+func cacheableRequest(req Request) bool {
+	if req.Method != "" && !strings.EqualFold(req.Method, http.MethodGet) {
+		return false
+	}
+	for name := range req.Headers {
+		if strings.EqualFold(name, "If-None-Match") || strings.EqualFold(name, "If-Modified-Since") ||
+			strings.EqualFold(name, "Authorization") {
+			return false
+		}
+	}
+	return true
+}
+
+// requestHeader возвращает заголовок запроса без учета регистра имени.
+func requestHeader(req Request, name string) string {
+	for key, value := range req.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// varyMatches проверяет, что закешированный ответ получен на запрос с теми же заголовками из Vary.
+func varyMatches(entry CachedResponse, req Request) bool {
+	for name, value := range entry.Vary {
+		if requestHeader(req, name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// withValidators добавляет к запросу условные заголовки из закешированного ответа.
+func withValidators(req Request, entry CachedResponse) Request {
+	headers := maps.Clone(req.Headers)
+	if headers == nil {
+		headers = make(map[string]string, 2)
+	}
+	if entry.ETag != "" {
+		headers["If-None-Match"] = entry.ETag
+	}
+	if entry.LastModified != "" {
+		headers["If-Modified-Since"] = entry.LastModified
+	}
+	req.Headers = headers
+	return req
+}
+
+// cacheExpiry разбирает Cache-Control ответа: до какого момента ответ свежий и можно ли его хранить.
+// Без max-age ответ хранится только для перепроверки по ETag / Last-Modified.
+func cacheExpiry(headers map[string]string, now time.Time) (time.Time, bool) {
+	expires := now
+	for _, directive := range strings.Split(headers["Cache-Control"], ",") {
+		name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+		switch name {
+		case "no-store":
+			return now, false
+		case "no-cache":
+			return now, true
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds > 0 {
+				expires = now.Add(time.Duration(seconds) * time.Second)
+			}
+		}
+	}
+	return expires, true
+}
+
+func newCachedResponse(req Request, resp *Response, now time.Time) (CachedResponse, bool) {
+	expires, storable := cacheExpiry(resp.Headers, now)
+	entry := CachedResponse{
+		Response:     cloneResponse(resp),
+		ETag:         resp.Headers["Etag"],
+		LastModified: resp.Headers["Last-Modified"],
+		Expires:      expires,
+	}
+	for _, name := range strings.Split(resp.Headers["Vary"], ",") {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		switch name {
+		case "":
+		case "*":
+			// ответ зависит не только от заголовков запроса - хранить его бессмысленно
+			return entry, false
+		default:
+			if entry.Vary == nil {
+				entry.Vary = make(map[string]string)
+			}
+			entry.Vary[name] = requestHeader(req, name)
+		}
+	}
+	useful := expires.After(now) || entry.ETag != "" || entry.LastModified != ""
+	return entry, storable && useful
+}
+
+func cloneResponse(resp *Response) *Response {
+	return &Response{
+		StatusCode: resp.StatusCode,
+		Body:       slices.Clone(resp.Body),
+		Headers:    maps.Clone(resp.Headers),
+	}
+}
+
+// LRUCache - ResponseCache в памяти, при переполнении вытесняется давно не использованный ответ.
+type LRUCache struct {
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List // от недавно использованных к давно
+	mu       *sync.Mutex
+}
+
+type lruItem struct {
+	key   string
+	entry CachedResponse
+}
+
+func NewLRUCache(capacity int) *LRUCache {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return &LRUCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element, capacity),
+		order:    list.New(),
+		mu:       &sync.Mutex{},
+	}
+}
+
+func (c *LRUCache) Get(key string) (CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, exists := c.items[key]
+	if !exists {
+		return CachedResponse{}, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruItem).entry, true
+}
+
+func (c *LRUCache) Set(key string, entry CachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, exists := c.items[key]; exists {
+		elem.Value.(*lruItem).entry = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruItem{key: key, entry: entry})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruItem).key)
+	}
+}
+
+func (c *LRUCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, exists := c.items[key]; exists {
+		c.order.Remove(elem)
+		delete(c.items, key)
+	}
 }
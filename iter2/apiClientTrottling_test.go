@@ -0,0 +1,1275 @@
+package main
+
+// Тесты запускаются вместе с файлом клиента:
+//
+//	go test -race iter2/apiClientTrottling.go iter2/apiClientTrottling_test.go
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient создает клиент без ограничений по скорости, чтобы тесты HTTP-части не ждали токены.
+func newTestClient(t *testing.T, config APIClientConfig) *APIClientEx {
+	t.Helper()
+	if config.RateLimit == 0 {
+		config.RateLimit = 600_000
+		config.Burst = 1000
+	}
+	api := NewApiClient(config)
+	t.Cleanup(func() { api.Close(context.Background()) })
+	return api
+}
+
+func TestJoinURL(t *testing.T) {
+	cases := []struct {
+		base, endpoint, want string
+		fails                bool
+	}{
+		{base: "http://api.local", endpoint: "users", want: "http://api.local/users"},
+		{base: "http://api.local/", endpoint: "/users", want: "http://api.local/users"},
+		{base: "http://api.local/v1", endpoint: "users?page=2", want: "http://api.local/v1/users?page=2"},
+		{base: "http://api.local/v1", endpoint: "", want: "http://api.local/v1"},
+		{base: "http://api.local", endpoint: "https://other.local/x", want: "https://other.local/x"},
+		{base: "", endpoint: "users", fails: true},
+		{base: "http://api.local", endpoint: "%zz", fails: true},
+	}
+	for _, tc := range cases {
+		got, err := joinURL(tc.base, tc.endpoint)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("joinURL(%q, %q) = %q, want error", tc.base, tc.endpoint, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("joinURL(%q, %q) = %q, %v, want %q", tc.base, tc.endpoint, got, err, tc.want)
+		}
+	}
+}
+
+func TestDoSendsHeadersAndBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPut || r.URL.Path != "/v1/items/7" || r.URL.Query().Get("dry") != "1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Echo", r.Header.Get("X-Token"))
+		w.Header().Add("X-Multi", "a")
+		w.Header().Add("X-Multi", "b")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	api := newTestClient(t, APIClientConfig{BaseURL: server.URL + "/v1"})
+	resp, err := api.Do(context.Background(), Request{
+		Method:   http.MethodPut,
+		Endpoint: "/items/7?dry=1",
+		Body:     []byte(`{"name":"x"}`),
+		Headers:  map[string]string{"X-Token": "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || string(resp.Body) != `{"name":"x"}` {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, resp.Body)
+	}
+	if resp.Headers["X-Echo"] != "secret" || resp.Headers["X-Multi"] != "a, b" {
+		t.Fatalf("unexpected headers %v", resp.Headers)
+	}
+}
+
+func TestDoDefaultTimeoutPerAttempt(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// первая попытка зависает, вторая отвечает сразу
+		if calls.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	api := newTestClient(t, APIClientConfig{BaseURL: server.URL, DefaultTimeout: 100 * time.Millisecond})
+	start := time.Now()
+	_, err := api.Do(context.Background(), Request{Endpoint: "slow"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("attempt was not limited by DefaultTimeout: %v", elapsed)
+	}
+
+	// таймаут действует на каждую попытку отдельно, а не на весь клиент
+	resp, err := api.Do(context.Background(), Request{Endpoint: "fast"})
+	if err != nil || string(resp.Body) != "ok" {
+		t.Fatalf("want second call to succeed, got %v", err)
+	}
+}
+
+func TestDoReturnsAPIErrorFor429And5xx(t *testing.T) {
+	statuses := map[string]int{"/limited": http.StatusTooManyRequests, "/broken": http.StatusBadGateway, "/missing": http.StatusNotFound}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[r.URL.Path])
+		w.Write([]byte("details"))
+	}))
+	defer server.Close()
+
+	api := newTestClient(t, APIClientConfig{BaseURL: server.URL})
+	cases := []struct {
+		endpoint string
+		sentinel error
+	}{
+		{endpoint: "/limited", sentinel: ErrTooManyRequests},
+		{endpoint: "/broken", sentinel: ErrServerError},
+	}
+	for _, tc := range cases {
+		resp, err := api.Do(context.Background(), Request{Endpoint: tc.endpoint})
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || !errors.Is(err, tc.sentinel) {
+			t.Fatalf("%s: want APIError wrapping %v, got %v", tc.endpoint, tc.sentinel, err)
+		}
+		if apiErr.StatusCode != statuses[tc.endpoint] || string(apiErr.Body) != "details" {
+			t.Fatalf("%s: unexpected APIError %+v", tc.endpoint, apiErr)
+		}
+		if resp == nil || resp.StatusCode != statuses[tc.endpoint] {
+			t.Fatalf("%s: want response together with error, got %+v", tc.endpoint, resp)
+		}
+	}
+
+	// 4xx, кроме 429, - обычный ответ без ошибки
+	resp, err := api.Do(context.Background(), Request{Endpoint: "/missing"})
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("want plain 404 response, got %+v, %v", resp, err)
+	}
+}
+
+// waitForTimers ждет, пока на FakeClock заведут n таймеров, то есть пока горутины заснут в ожидании.
+func waitForTimers(t *testing.T, clock *FakeClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Waiters() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d waiting timers, got %d", n, clock.Waiters())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTokenBucketRefillsContinuously(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	tb := NewTokenBucket(60, 1, clock)
+
+	if !tb.Allow() || tb.Allow() {
+		t.Fatal("want exactly one token at start")
+	}
+	// 60 в минуту - токен в секунду, пополнение идет непрерывно, а не раз в секунду пачкой
+	clock.Advance(500 * time.Millisecond)
+	if tb.Allow() {
+		t.Fatal("token available after half of the interval")
+	}
+	clock.Advance(500 * time.Millisecond)
+	if !tb.Allow() {
+		t.Fatal("want a token after the full interval")
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	tb := NewTokenBucket(60, 5, clock)
+
+	for i := 0; i < 5; i++ {
+		if !tb.Allow() {
+			t.Fatalf("want burst of 5, token %d denied", i+1)
+		}
+	}
+	if tb.Allow() {
+		t.Fatal("burst exceeded")
+	}
+	// простой не копит токены сверх burst
+	clock.Advance(time.Hour)
+	allowed := 0
+	for tb.Allow() {
+		allowed++
+	}
+	if allowed != 5 {
+		t.Fatalf("want 5 tokens after a long pause, got %d", allowed)
+	}
+}
+
+func TestTokenBucketWaitCancelRefundsToken(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	tb := NewTokenBucket(60, 1, clock)
+	tb.Allow()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- tb.Wait(ctx) }()
+	waitForTimers(t, clock, 1)
+
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("want Canceled, got %v", err)
+	}
+	// отмененное ожидание не оставляет таймер и возвращает зарезервированный токен
+	if waiters := clock.Waiters(); waiters != 0 {
+		t.Fatalf("want no orphaned timers, got %d", waiters)
+	}
+	clock.Advance(time.Second)
+	if !tb.Allow() {
+		t.Fatal("reserved token was not refunded")
+	}
+}
+
+func TestTokenBucketWaitGetsTokenInTime(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	tb := NewTokenBucket(60, 1, clock)
+	tb.Allow()
+
+	errs := make(chan error, 1)
+	go func() { errs <- tb.Wait(context.Background()) }()
+	waitForTimers(t, clock, 1)
+
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case err := <-errs:
+		t.Fatalf("Wait returned before its token was ready: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenBucketWaitRejectsShortDeadline(t *testing.T) {
+	start := time.Now()
+	clock := NewFakeClock(start)
+	tb := NewTokenBucket(60, 1, clock)
+	tb.Allow()
+
+	// дедлайн сравнивается со временем bucket-а: до него 100ms, а токен появится через секунду
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(100*time.Millisecond))
+	defer cancel()
+	if err := tb.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+	if waiters := clock.Waiters(); waiters != 0 {
+		t.Fatalf("rejected Wait should not sleep, got %d timers", waiters)
+	}
+	clock.Advance(time.Second)
+	if !tb.Allow() {
+		t.Fatal("rejected Wait kept its reservation")
+	}
+}
+
+func newTestScheduler(t *testing.T, clock *FakeClock, config APIClientConfig) *requestScheduler {
+	t.Helper()
+	if config.UrgentWeight == 0 {
+		config.UrgentWeight = 4
+	}
+	if config.MaxQueueWait == 0 {
+		config.MaxQueueWait = 5 * time.Second
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = 100
+	}
+	return newRequestScheduler(config, clock)
+}
+
+func pushRequest(t *testing.T, s *requestScheduler, name string, urgent bool) {
+	t.Helper()
+	req := &ClientRequest{
+		req:        Request{Endpoint: name, Urgent: urgent},
+		resultChan: make(chan Result, 1),
+		context:    context.Background(),
+	}
+	if err := s.push(context.Background(), nil, req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func popOrder(s *requestScheduler, n int) []string {
+	order := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		req, _ := s.pop()
+		if req == nil {
+			break
+		}
+		order = append(order, req.req.Endpoint)
+	}
+	return order
+}
+
+func TestSchedulerInterleavesUrgentAndNormal(t *testing.T) {
+	s := newTestScheduler(t, NewFakeClock(time.Now()), APIClientConfig{})
+	for i := 0; i < 3; i++ {
+		pushRequest(t, s, "n"+strconv.Itoa(i), false)
+	}
+	for i := 0; i < 10; i++ {
+		pushRequest(t, s, "u"+strconv.Itoa(i), true)
+	}
+
+	// 4 urgent-запроса подряд, затем один обычный
+	want := []string{"u0", "u1", "u2", "u3", "n0", "u4", "u5", "u6", "u7", "n1", "u8", "u9", "n2"}
+	if got := popOrder(s, len(want)+1); !slices.Equal(got, want) {
+		t.Fatalf("want order %v, got %v", want, got)
+	}
+}
+
+func TestSchedulerAgesNormalRequests(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	s := newTestScheduler(t, clock, APIClientConfig{UrgentWeight: 100, MaxQueueWait: 5 * time.Second})
+	pushRequest(t, s, "n0", false)
+	clock.Advance(time.Second)
+	pushRequest(t, s, "n1", false)
+	for i := 0; i < 10; i++ {
+		pushRequest(t, s, "u"+strconv.Itoa(i), true)
+	}
+
+	if got := popOrder(s, 2); !slices.Equal(got, []string{"u0", "u1"}) {
+		t.Fatalf("before MaxQueueWait urgent requests go first, got %v", got)
+	}
+	// n0 ждет 5s - уходит вне очереди, n1 ждет только 4s
+	clock.Advance(4 * time.Second)
+	if got := popOrder(s, 2); !slices.Equal(got, []string{"n0", "u2"}) {
+		t.Fatalf("want aged n0 before urgent requests, got %v", got)
+	}
+	clock.Advance(time.Second)
+	if got := popOrder(s, 2); !slices.Equal(got, []string{"n1", "u3"}) {
+		t.Fatalf("want aged n1 before urgent requests, got %v", got)
+	}
+}
+
+func TestCloseWaitsForConcurrentCalls(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	api := NewApiClient(APIClientConfig{BaseURL: server.URL, RateLimit: 600_000, Burst: 100, Workers: 4, QueueSize: 1000})
+	var wg sync.WaitGroup
+	var succeeded, closed atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := api.Do(context.Background(), Request{Endpoint: "item"})
+			switch {
+			case err == nil:
+				succeeded.Add(1)
+			case errors.Is(err, ErrClientClosed):
+				closed.Add(1)
+			default:
+				t.Errorf("unexpected error %v", err)
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	// без дедлайна Close дожидается всех принятых вызовов
+	if err := api.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if succeeded.Load() == 0 || succeeded.Load()+closed.Load() != 50 {
+		t.Fatalf("succeeded=%d closed=%d", succeeded.Load(), closed.Load())
+	}
+}
+
+func TestCloseDeadlineAbortsQueuedCalls(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// токен раз в минуту: первый запрос уходит сразу, остальные ждут в очереди
+	api := NewApiClient(APIClientConfig{BaseURL: server.URL, RateLimit: 1, Burst: 1, QueueSize: 10})
+	if _, err := api.Do(context.Background(), Request{Endpoint: "first"}); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := api.Do(context.Background(), Request{Endpoint: "queued"})
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		urgent, normal, _ := api.scheduler.depth()
+		if urgent+normal == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("requests did not reach the queue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := api.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want Close to report the expired deadline, got %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := <-errs; !errors.Is(err, ErrClientClosed) {
+			t.Fatalf("want ErrClientClosed for queued call, got %v", err)
+		}
+	}
+}
+
+func TestDoAfterClose(t *testing.T) {
+	api := NewApiClient(APIClientConfig{BaseURL: "http://127.0.0.1:0"})
+	if err := api.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.Do(context.Background(), Request{Endpoint: "item"}); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("want ErrClientClosed, got %v", err)
+	}
+	if err := api.Close(context.Background()); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("want ErrClientClosed from second Close, got %v", err)
+	}
+}
+
+func TestPostRetriedWithGeneratedIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get(idempotencyKeyHeader))
+		attempt := len(keys)
+		mu.Unlock()
+		if attempt < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	received := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		sent := keys
+		keys = nil
+		return sent
+	}
+
+	retry := &RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond}
+	api := newTestClient(t, APIClientConfig{BaseURL: server.URL})
+	resp, err := api.Do(context.Background(), Request{Method: http.MethodPost, Endpoint: "orders", Retry: retry})
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want POST to succeed on retry, got %+v, %v", resp, err)
+	}
+	if sent := received(); len(sent) != 3 || sent[0] == "" || sent[1] != sent[0] || sent[2] != sent[0] {
+		t.Fatalf("want the same generated key on every attempt, got %q", sent)
+	}
+
+	// без генерации ключей POST без ключа не повторяется
+	api = newTestClient(t, APIClientConfig{BaseURL: server.URL, DisableIdempotencyKeys: true})
+	_, err = api.Do(context.Background(), Request{Method: http.MethodPost, Endpoint: "orders", Retry: retry})
+	if sent := received(); !errors.Is(err, ErrServerError) || len(sent) != 1 || sent[0] != "" {
+		t.Fatalf("want a single attempt without key, got %q, %v", sent, err)
+	}
+}
+
+func TestCacheSeparatesTenantsAndVary(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/wild" {
+			w.Header().Set("Vary", "*")
+		} else {
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		io.WriteString(w, r.Header.Get("X-Tenant")+r.Header.Get("Accept-Language"))
+	}))
+	defer server.Close()
+
+	api := newTestClient(t, APIClientConfig{BaseURL: server.URL, Cache: NewLRUCache(16)})
+	get := func(endpoint, tenant string, headers map[string]string) string {
+		t.Helper()
+		all := map[string]string{"X-Tenant": tenant}
+		for name, value := range headers {
+			all[name] = value
+		}
+		resp, err := api.Do(context.Background(), Request{Endpoint: endpoint, Tenant: tenant, Headers: all})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(resp.Body)
+	}
+	ru := map[string]string{"Accept-Language": "ru"}
+	en := map[string]string{"Accept-Language": "en"}
+
+	if body := get("items", "a", ru); body != "aru" {
+		t.Fatalf("tenant a got %q", body)
+	}
+	if body := get("items", "b", ru); body != "bru" {
+		t.Fatalf("tenant b got a cached response of another tenant: %q", body)
+	}
+	if body := get("items", "a", ru); body != "aru" || hits.Load() != 2 {
+		t.Fatalf("want cached %q without request, got %q after %d requests", "aru", body, hits.Load())
+	}
+	if body := get("items", "a", en); body != "aen" || hits.Load() != 3 {
+		t.Fatalf("want a request for another Accept-Language, got %q after %d requests", body, hits.Load())
+	}
+
+	// ответы на запросы с Authorization и ответы с Vary: * не кешируются
+	auth := map[string]string{"Authorization": "Bearer a"}
+	get("private", "a", auth)
+	get("private", "a", auth)
+	get("wild", "a", nil)
+	get("wild", "a", nil)
+	if hits.Load() != 7 {
+		t.Fatalf("want 7 requests to the server, got %d", hits.Load())
+	}
+}
+
+func TestIdleTenantsExpire(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	s := newTestScheduler(t, clock, APIClientConfig{TenantRateLimit: 60, TenantBurst: 1, TenantIdleTimeout: time.Minute})
+	metrics := newClientMetrics(clock, time.Minute)
+	serve := func(tenant string) {
+		t.Helper()
+		req := &ClientRequest{
+			req:        Request{Endpoint: "items", Tenant: tenant},
+			resultChan: make(chan Result, 1),
+			context:    context.Background(),
+		}
+		if err := s.push(context.Background(), nil, req); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := s.pop(); got != req {
+			t.Fatalf("want request of tenant %q, got %v", tenant, got)
+		}
+		metrics.recordRequest(req.req, &Response{StatusCode: http.StatusOK}, nil)
+	}
+
+	for i := range 50 {
+		serve("t" + strconv.Itoa(i))
+	}
+	// сразу после выдачи токена sub-bucket не полный, тенанты остаются
+	if len(s.tenants) != 50 || len(metrics.tenants) != 50 {
+		t.Fatalf("want 50 tracked tenants, got %d in scheduler and %d in metrics", len(s.tenants), len(metrics.tenants))
+	}
+
+	clock.Advance(time.Minute)
+	serve("active")
+	if _, ok := s.tenants["active"]; len(s.tenants) != 1 || !ok {
+		t.Fatalf("want only the active tenant in scheduler, got %d tenants", len(s.tenants))
+	}
+	if _, ok := metrics.tenants["active"]; len(metrics.tenants) != 1 || !ok {
+		t.Fatalf("want only the active tenant in metrics, got %d tenants", len(metrics.tenants))
+	}
+}
+
+// pushTenant ставит в очередь запросы тенанта с именами <tenant>0, <tenant>1, ...
+func pushTenant(t *testing.T, s *requestScheduler, tenant string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		req := &ClientRequest{
+			req:        Request{Endpoint: tenant + strconv.Itoa(i), Tenant: tenant},
+			resultChan: make(chan Result, 1),
+			context:    context.Background(),
+		}
+		if err := s.push(context.Background(), nil, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSchedulerSharesLimitBetweenTenants(t *testing.T) {
+	s := newTestScheduler(t, NewFakeClock(time.Now()), APIClientConfig{})
+	pushTenant(t, s, "a", 6)
+	pushTenant(t, s, "b", 2)
+	pushTenant(t, s, "c", 1)
+
+	// тенанты с запросами в очереди получают токены по очереди, а когда у b и c запросы
+	// заканчиваются, их доля общего лимита целиком достается a
+	want := []string{"a0", "b0", "c0", "a1", "b1", "a2", "a3", "a4", "a5"}
+	if order := popOrder(s, 10); !slices.Equal(order, want) {
+		t.Fatalf("want %v, got %v", want, order)
+	}
+}
+
+func TestSchedulerGivesExhaustedTenantShareToOthers(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	s := newTestScheduler(t, clock, APIClientConfig{TenantRateLimit: 60, TenantBurst: 2})
+	pushTenant(t, s, "a", 4)
+	if order := popOrder(s, 4); !slices.Equal(order, []string{"a0", "a1"}) {
+		t.Fatalf("want tenant a limited by its burst, got %v", order)
+	}
+	if req, retryIn := s.pop(); req != nil || retryIn <= 0 || retryIn > time.Second {
+		t.Fatalf("want the next token of a in 1s, got %v, %v", req, retryIn)
+	}
+
+	// a стоит в очереди раньше, но его лимит исчерпан, и общий токен уходит b
+	pushTenant(t, s, "b", 1)
+	if order := popOrder(s, 2); !slices.Equal(order, []string{"b0"}) {
+		t.Fatalf("want b served while a is limited, got %v", order)
+	}
+	clock.Advance(time.Second)
+	if order := popOrder(s, 3); !slices.Equal(order, []string{"a2"}) {
+		t.Fatalf("want a served after its token refills, got %v", order)
+	}
+}
+
+// racingClock воспроизводит гонку pop с повтором тенанта из waitTenant: первый вызов Now после того,
+// как bucket проверили под его мьютексом, забирает токен bucket-а, как это сделал бы конкурент.
+type racingClock struct {
+	*FakeClock
+	bucket  *TokenBucket
+	checked bool
+	taken   bool
+}
+
+func (c *racingClock) Now() time.Time {
+	if c.bucket != nil && !c.taken {
+		if !c.bucket.mu.TryLock() {
+			c.checked = true
+		} else {
+			if c.checked {
+				c.bucket.tokens--
+				c.taken = true
+			}
+			c.bucket.mu.Unlock()
+		}
+	}
+	return c.FakeClock.Now()
+}
+
+func TestSchedulerPopDoesNotOverspendTenantToken(t *testing.T) {
+	clock := &racingClock{FakeClock: NewFakeClock(time.Now())}
+	s := newRequestScheduler(APIClientConfig{
+		UrgentWeight:      4,
+		MaxQueueWait:      5 * time.Second,
+		QueueSize:         100,
+		TenantRateLimit:   60,
+		TenantBurst:       1,
+		TenantIdleTimeout: time.Minute,
+	}, clock)
+	pushTenant(t, s, "a", 1)
+
+	// токен ушел повтору, пока pop выбирал запрос: запрос остается в очереди до следующего токена
+	clock.bucket = s.tenants["a"].bucket
+	if req, retryIn := s.pop(); req != nil || retryIn <= 0 {
+		t.Fatalf("want request to wait for the next tenant token, got %v, %v", req, retryIn)
+	}
+	if !clock.taken {
+		t.Fatal("token was not taken during pop")
+	}
+	clock.Advance(time.Second)
+	if order := popOrder(s, 2); !slices.Equal(order, []string{"a0"}) {
+		t.Fatalf("want the request served after the token refills, got %v", order)
+	}
+}
+
+// Тенант, повтор которого ждет токен, не забывается, даже если его очередь пуста.
+func TestSweepKeepsTenantsWithWaitingRetries(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	s := newTestScheduler(t, clock, APIClientConfig{TenantRateLimit: 1, TenantBurst: 1, TenantIdleTimeout: 30 * time.Second})
+	tracked := func(tenant string) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_, exists := s.tenants[tenant]
+		return exists
+	}
+	// sweep срабатывает при выдаче запроса, поэтому его запускает запрос другого тенанта
+	serveOther := func(tenant string) {
+		t.Helper()
+		pushTenant(t, s, tenant, 1)
+		if req, _ := s.pop(); req == nil || req.req.Tenant != tenant {
+			t.Fatalf("want request of %s, got %v", tenant, req)
+		}
+	}
+
+	pushTenant(t, s, "a", 1)
+	if req, _ := s.pop(); req == nil {
+		t.Fatal("want request of a")
+	}
+	// следующий токен a будет через минуту, повтор ждет его с пустой очередью
+	retried := make(chan error, 1)
+	go func() {
+		_, err := s.waitTenant(context.Background(), "a")
+		retried <- err
+	}()
+	waitForTimers(t, clock, 1)
+
+	clock.Advance(30 * time.Second)
+	serveOther("b")
+	if !tracked("a") {
+		t.Fatal("want tenant a kept while its retry waits for a token")
+	}
+
+	clock.Advance(30 * time.Second)
+	if err := <-retried; err != nil {
+		t.Fatal(err)
+	}
+	// повтор потратил пополненный токен, sub-bucket снова пуст
+	serveOther("c")
+	if !tracked("a") {
+		t.Fatal("want tenant a kept until its sub-bucket refills")
+	}
+
+	clock.Advance(time.Minute)
+	serveOther("d")
+	if tracked("a") || tracked("b") {
+		t.Fatal("want idle tenants forgotten after their sub-buckets refilled")
+	}
+}
+
+func TestRetryWaitsForTenantToken(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	clock := NewFakeClock(time.Now())
+	api := newTestClient(t, APIClientConfig{
+		BaseURL:         server.URL,
+		RateLimit:       600_000,
+		Burst:           1000,
+		Clock:           clock,
+		TenantRateLimit: 60,
+		TenantBurst:     1,
+	})
+	done := make(chan error, 1)
+	go func() {
+		req := Request{Endpoint: "items", Tenant: "noisy", Retry: &RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond}}
+		_, err := api.Do(context.Background(), req)
+		done <- err
+	}()
+
+	// первую попытку тенант оплатил своим единственным токеном, повтор ждет следующий
+	waitForTimers(t, clock, 1)
+	if hits.Load() != 1 {
+		t.Fatalf("want retry to wait for the tenant token, got %d attempts", hits.Load())
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil || hits.Load() != 2 {
+		t.Fatalf("want retry to succeed after the tenant token, got %v after %d attempts", err, hits.Load())
+	}
+}
+
+func TestRateLimitPause(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name    string
+		status  int
+		headers map[string]string
+		until   time.Time
+		paused  bool
+	}{
+		{name: "retry after seconds", status: 429, headers: map[string]string{"Retry-After": "5"}, until: now.Add(5 * time.Second), paused: true},
+		{name: "retry after date", status: 503, headers: map[string]string{"Retry-After": now.Add(time.Minute).Format(http.TimeFormat)}, until: now.Add(time.Minute), paused: true},
+		{name: "retry after zero", status: 429, headers: map[string]string{"Retry-After": "0"}},
+		{name: "retry after past date", status: 429, headers: map[string]string{"Retry-After": now.Add(-time.Minute).Format(http.TimeFormat)}},
+		{name: "retry after on 500", status: 500, headers: map[string]string{"Retry-After": "5"}},
+		{name: "reset in seconds", status: 200, headers: map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "30"}, until: now.Add(30 * time.Second), paused: true},
+		{name: "reset unix time", status: 200, headers: map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": strconv.FormatInt(now.Add(time.Hour).Unix(), 10)}, until: now.Add(time.Hour), paused: true},
+		{name: "requests remain", status: 200, headers: map[string]string{"X-RateLimit-Remaining": "3", "X-RateLimit-Reset": "30"}},
+		{name: "malformed retry after", status: 429, headers: map[string]string{"Retry-After": "soon"}},
+		{name: "negative retry after", status: 429, headers: map[string]string{"Retry-After": "-3"}},
+		{name: "malformed reset", status: 200, headers: map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "tomorrow"}},
+		{name: "negative reset", status: 200, headers: map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "-5"}},
+		{name: "reset without remaining", status: 200, headers: map[string]string{"X-RateLimit-Reset": "30"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Response хранит заголовки в каноническом виде, как их отдает net/http
+			headers := make(map[string]string, len(tc.headers))
+			for name, value := range tc.headers {
+				headers[http.CanonicalHeaderKey(name)] = value
+			}
+			until, paused := rateLimitPause(&Response{StatusCode: tc.status, Headers: headers}, now)
+			if paused != tc.paused || (tc.paused && !until.Equal(tc.until)) {
+				t.Fatalf("want %v, %v, got %v, %v", tc.until, tc.paused, until, paused)
+			}
+		})
+	}
+}
+
+func TestTokenBucketPauseSpreadsWaiters(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	tb := NewTokenBucket(60, 1, clock)
+	if !tb.Allow() {
+		t.Fatal("want the initial token")
+	}
+
+	// три вызова резервируют токены на 1s, 2s и 3s
+	done := make(chan int, 3)
+	for i := range 3 {
+		go func() {
+			if err := tb.Wait(context.Background()); err != nil {
+				t.Error(err)
+			}
+			done <- i
+		}()
+		waitForTimers(t, clock, i+1)
+	}
+
+	tb.Pause(clock.Now().Add(10 * time.Second))
+	clock.Advance(10 * time.Second)
+	// таймеры ожидающих сработали, но их токены сдвинулись на длину паузы
+	waitForTimers(t, clock, 3)
+	if len(done) != 0 {
+		t.Fatalf("want waiters to stay paused, %d finished", len(done))
+	}
+
+	for i := range 3 {
+		clock.Advance(time.Second)
+		select {
+		case got := <-done:
+			if got != i {
+				t.Fatalf("want waiter %d, got %d", i, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("waiter %d did not get its token", i)
+		}
+		waitForTimers(t, clock, 2-i)
+		if len(done) != 0 {
+			t.Fatalf("want one waiter per refill interval after the pause, got %d more", len(done))
+		}
+	}
+}
+
+func TestCacheRevalidatesWithValidators(t *testing.T) {
+	const lastModified = "Mon, 19 Oct 2026 10:00:00 GMT"
+	var mu sync.Mutex
+	var validators [][2]string
+	revalidated := "max-age=60"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		validators = append(validators, [2]string{r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since")})
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("Cache-Control", revalidated)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified)
+		io.WriteString(w, "v1")
+	}))
+	defer server.Close()
+	sent := func() [][2]string {
+		mu.Lock()
+		defer mu.Unlock()
+		got := validators
+		validators = nil
+		return got
+	}
+
+	clock := NewFakeClock(time.Now())
+	api := newTestClient(t, APIClientConfig{BaseURL: server.URL, Cache: NewLRUCache(16), Clock: clock, RateLimit: 600_000, Burst: 1000})
+	get := func() {
+		t.Helper()
+		resp, err := api.Do(context.Background(), Request{Endpoint: "items"})
+		if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != "v1" {
+			t.Fatalf("want 200 v1, got %+v, %v", resp, err)
+		}
+	}
+
+	get()
+	get()
+	if got := sent(); len(got) != 1 || got[0] != [2]string{} {
+		t.Fatalf("want one request without validators while the response is fresh, got %q", got)
+	}
+
+	// ответ устарел: запрос уходит с If-None-Match и If-Modified-Since, 304 продлевает его на max-age
+	clock.Advance(61 * time.Second)
+	get()
+	get()
+	if got := sent(); len(got) != 1 || got[0] != [2]string{`"v1"`, lastModified} {
+		t.Fatalf("want one conditional request, got %q", got)
+	}
+
+	// 304 с no-store: ответ отдается, но из кеша удаляется
+	mu.Lock()
+	revalidated = "no-store"
+	mu.Unlock()
+	clock.Advance(61 * time.Second)
+	get()
+	get()
+	if got := sent(); len(got) != 2 || got[0][0] != `"v1"` || got[1] != [2]string{} {
+		t.Fatalf("want the entry evicted after 304 with no-store, got %q", got)
+	}
+
+	var fresh, revalidations uint64
+	for _, em := range api.Metrics().Endpoints {
+		fresh += em.CacheHits
+		revalidations += em.CacheRevalidated
+	}
+	if fresh != 2 || revalidations != 2 {
+		t.Fatalf("want 2 fresh and 2 revalidated cache responses, got %d and %d", fresh, revalidations)
+	}
+}
+
+// newOverloadedClient возвращает клиент с токеном раз в минуту, который уже потратил свой единственный токен:
+// следующие запросы остаются в очереди.
+func newOverloadedClient(t *testing.T, policy OverloadPolicy) *APIClientEx {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	api := newTestClient(t, APIClientConfig{BaseURL: server.URL, RateLimit: 1, Burst: 1, QueueSize: 2, OverloadPolicy: policy})
+	if _, err := api.Do(context.Background(), Request{Endpoint: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// очередь не разберется раньше чем через минуту - прерываем ожидающие вызовы
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		api.Close(ctx)
+	})
+	return api
+}
+
+// enqueue отправляет запрос в фоне и ждет, пока очередь не станет нужной глубины.
+func enqueue(t *testing.T, api *APIClientEx, req Request, urgent, normal int) chan error {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := api.Do(context.Background(), req)
+		errs <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		depth := api.Metrics().QueueDepth
+		if depth["urgent"] == urgent && depth["normal"] == normal {
+			return errs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want queue depth %d urgent, %d normal, got %v", urgent, normal, depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOverloadRejectReturnsErrQueueFull(t *testing.T) {
+	api := newOverloadedClient(t, OverloadReject)
+	enqueue(t, api, Request{Endpoint: "n0"}, 0, 1)
+	enqueue(t, api, Request{Endpoint: "u0", Urgent: true}, 1, 1)
+
+	for _, req := range []Request{{Endpoint: "n1"}, {Endpoint: "u1", Urgent: true}} {
+		if _, err := api.Do(context.Background(), req); !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("want ErrQueueFull for %s, got %v", req.Endpoint, err)
+		}
+	}
+	if depth := api.Metrics().QueueDepth; depth["urgent"] != 1 || depth["normal"] != 1 {
+		t.Fatalf("rejected requests must not change the queue, got %v", depth)
+	}
+}
+
+func TestOverloadDropOldestKeepsUrgentRequests(t *testing.T) {
+	api := newOverloadedClient(t, OverloadDropOldest)
+	n0 := enqueue(t, api, Request{Endpoint: "n0"}, 0, 1)
+	n1 := enqueue(t, api, Request{Endpoint: "n1"}, 0, 2)
+
+	// новый обычный запрос вытесняет самый старый обычный
+	n2 := enqueue(t, api, Request{Endpoint: "n2"}, 0, 2)
+	if err := <-n0; !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("want oldest request to get ErrQueueFull, got %v", err)
+	}
+
+	// urgent-запросы тоже вытесняют обычные
+	enqueue(t, api, Request{Endpoint: "u0", Urgent: true}, 1, 1)
+	if err := <-n1; !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("want n1 to be dropped for urgent request, got %v", err)
+	}
+	enqueue(t, api, Request{Endpoint: "u1", Urgent: true}, 2, 0)
+	if err := <-n2; !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("want n2 to be dropped for urgent request, got %v", err)
+	}
+
+	// в очереди только urgent-запросы, их не вытесняет никто
+	for _, req := range []Request{{Endpoint: "n3"}, {Endpoint: "u2", Urgent: true}} {
+		if _, err := api.Do(context.Background(), req); !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("want ErrQueueFull for %s, got %v", req.Endpoint, err)
+		}
+	}
+	if depth := api.Metrics().QueueDepth; depth["urgent"] != 2 || depth["normal"] != 0 {
+		t.Fatalf("want both urgent requests to stay queued, got %v", depth)
+	}
+}
+
+func TestRetryTransportErrorsWithClockBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get(idempotencyKeyHeader))
+		attempt := len(keys)
+		mu.Unlock()
+		switch attempt {
+		case 1:
+			// соединение рвется без ответа
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		case 2:
+			// попытка не укладывается в DefaultTimeout
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+	attempts := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(keys)
+	}
+
+	clock := NewFakeClock(time.Now())
+	api := newTestClient(t, APIClientConfig{
+		BaseURL:        server.URL,
+		RateLimit:      600_000,
+		Burst:          1000,
+		Clock:          clock,
+		DefaultTimeout: 50 * time.Millisecond,
+	})
+	done := make(chan error, 1)
+	var resp *Response
+	go func() {
+		var err error
+		req := Request{Method: http.MethodPost, Endpoint: "orders", Retry: &RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Second}}
+		resp, err = api.Do(context.Background(), req)
+		done <- err
+	}()
+
+	// пауза перед повтором идет по часам клиента: пока они стоят, следующей попытки нет
+	for attempt := 1; attempt <= 2; attempt++ {
+		waitForTimers(t, clock, 1)
+		if got := attempts(); got != attempt {
+			t.Fatalf("want retry to wait for the backoff timer, got %d attempts", got)
+		}
+		clock.Advance(2 * time.Second)
+	}
+
+	if err := <-done; err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("want POST to succeed after transport errors, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(keys) != 3 || keys[0] == "" || keys[1] != keys[0] || keys[2] != keys[0] {
+		t.Fatalf("want the same idempotency key on every attempt, got %q", keys)
+	}
+}
+
+// runScriptedMetrics проигрывает на клиенте с FakeClock фиксированный набор вызовов. Сервер сдвигает часы
+// клиента на свое "время ответа", поэтому гистограммы детерминированы.
+func runScriptedMetrics(t *testing.T) *APIClientEx {
+	t.Helper()
+	clock := NewFakeClock(time.Now())
+	var flaky atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/items":
+			clock.Advance(30 * time.Millisecond)
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, "items")
+		case "/missing":
+			clock.Advance(200 * time.Millisecond)
+			w.WriteHeader(http.StatusNotFound)
+		case "/flaky":
+			if flaky.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			clock.Advance(2 * time.Second)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	api := newTestClient(t, APIClientConfig{
+		BaseURL:   server.URL,
+		RateLimit: 600_000,
+		Burst:     1000,
+		Clock:     clock,
+		Cache:     NewLRUCache(10),
+	})
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := api.Do(ctx, Request{Endpoint: "items?page=1", Tenant: "acme"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resp, err := api.Do(ctx, Request{Endpoint: "missing", Tenant: "acme"}); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("want 404, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := api.Do(ctx, Request{Endpoint: "flaky", Urgent: true, Retry: &RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Second}})
+		done <- err
+	}()
+	waitForTimers(t, clock, 1)
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+// histogramCounts возвращает количество замеров по бакетам гистограммы: граница -> count, +Inf - math.Inf.
+func histogramCounts(h APIHistogram) map[float64]uint64 {
+	counts := make(map[float64]uint64)
+	for idx, count := range h.Counts {
+		if count == 0 {
+			continue
+		}
+		bound := math.Inf(1)
+		if idx < len(h.Bounds) {
+			bound = h.Bounds[idx]
+		}
+		counts[bound] = count
+	}
+	return counts
+}
+
+func TestMetricsAfterScriptedRun(t *testing.T) {
+	snapshot := runScriptedMetrics(t).Metrics()
+
+	endpoints := make(map[string]APIEndpointMetrics)
+	for _, em := range snapshot.Endpoints {
+		endpoints[em.Endpoint+" "+em.Priority] = em
+	}
+	if len(endpoints) != 3 {
+		t.Fatalf("want 3 endpoints, got %+v", snapshot.Endpoints)
+	}
+
+	items := endpoints["items normal"]
+	if items.Requests != 2 || items.CacheHits != 1 || items.Retries != 0 || len(items.Errors) != 0 {
+		t.Fatalf("unexpected counters for items: %+v", items)
+	}
+	if counts := histogramCounts(items.ServerTime); !maps.Equal(counts, map[float64]uint64{0.05: 1}) || math.Abs(items.ServerTime.Sum-0.03) > 1e-9 {
+		t.Fatalf("want one 30ms attempt in server time, got %v with sum %v", counts, items.ServerTime.Sum)
+	}
+	// из кеша ответ отдается без очереди, в очереди побывал только первый вызов
+	if items.QueueTime.Count != 1 || items.QueueTime.Sum != 0 {
+		t.Fatalf("want one queued call, got %+v", items.QueueTime)
+	}
+
+	missing := endpoints["missing normal"]
+	if missing.Requests != 1 || !maps.Equal(missing.Errors, map[string]uint64{"4xx": 1}) {
+		t.Fatalf("unexpected counters for missing: %+v", missing)
+	}
+	if counts := histogramCounts(missing.ServerTime); !maps.Equal(counts, map[float64]uint64{0.25: 1}) {
+		t.Fatalf("want one 200ms attempt in server time, got %v", counts)
+	}
+
+	flaky := endpoints["flaky urgent"]
+	if flaky.Requests != 1 || flaky.Retries != 1 || len(flaky.Errors) != 0 {
+		t.Fatalf("unexpected counters for flaky: %+v", flaky)
+	}
+	if counts := histogramCounts(flaky.ServerTime); !maps.Equal(counts, map[float64]uint64{0.005: 1, 2.5: 1}) || flaky.ServerTime.Count != 2 {
+		t.Fatalf("want both attempts in server time, got %v", counts)
+	}
+
+	tenants := make(map[string]APITenantMetrics)
+	for _, tm := range snapshot.Tenants {
+		tenants[tm.Tenant] = tm
+	}
+	if acme := tenants["acme"]; acme.Requests != 3 || acme.Errors != 1 || acme.Dispatched != 2 {
+		t.Fatalf("unexpected tenant metrics: %+v", acme)
+	}
+	if snapshot.QueueDepth["urgent"] != 0 || snapshot.QueueDepth["normal"] != 0 {
+		t.Fatalf("want empty queue, got %v", snapshot.QueueDepth)
+	}
+}
+
+func TestMetricsHandlerPrometheusFormat(t *testing.T) {
+	api := runScriptedMetrics(t)
+	recorder := httptest.NewRecorder()
+	api.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	types := make(map[string]string)
+	present := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		present[line] = true
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			name, kind, _ := strings.Cut(rest, " ")
+			types[name] = kind
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		// строка значения - "имя{метки} число", и тип метрики объявлен до нее
+		name, rest, ok := strings.Cut(line, "{")
+		labels, value, ok2 := strings.Cut(rest, "} ")
+		if !ok || !ok2 || labels == "" {
+			t.Fatalf("malformed metric line %q", line)
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			t.Fatalf("malformed value in %q", line)
+		}
+		base := name
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if trimmed, ok := strings.CutSuffix(name, suffix); ok && types[trimmed] == "histogram" {
+				base = trimmed
+			}
+		}
+		if types[base] == "" {
+			t.Fatalf("metric %s has no TYPE before %q", base, line)
+		}
+	}
+
+	want := []string{
+		"# TYPE api_client_requests_total counter",
+		`api_client_requests_total{endpoint="items",priority="normal"} 2`,
+		`api_client_retries_total{endpoint="flaky",priority="urgent"} 1`,
+		`api_client_errors_total{endpoint="missing",priority="normal",class="4xx"} 1`,
+		`api_client_cache_responses_total{endpoint="items",priority="normal",source="fresh"} 1`,
+		`api_client_cache_responses_total{endpoint="items",priority="normal",source="revalidated"} 0`,
+		"# TYPE api_client_server_time_seconds histogram",
+		`api_client_server_time_seconds_bucket{endpoint="flaky",priority="urgent",le="0.005"} 1`,
+		`api_client_server_time_seconds_bucket{endpoint="flaky",priority="urgent",le="1"} 1`,
+		`api_client_server_time_seconds_bucket{endpoint="flaky",priority="urgent",le="2.5"} 2`,
+		`api_client_server_time_seconds_bucket{endpoint="flaky",priority="urgent",le="+Inf"} 2`,
+		`api_client_server_time_seconds_sum{endpoint="flaky",priority="urgent"} 2`,
+		`api_client_server_time_seconds_count{endpoint="flaky",priority="urgent"} 2`,
+		`api_client_queue_time_seconds_count{endpoint="items",priority="normal"} 1`,
+		`api_client_queue_depth{priority="urgent"} 0`,
+		`api_client_tenant_requests_total{tenant="acme"} 3`,
+		`api_client_tenant_errors_total{tenant="acme"} 1`,
+		`api_client_tenant_dispatched_total{tenant="acme"} 2`,
+	}
+	for _, line := range want {
+		if !present[line] {
+			t.Errorf("missing line %q", line)
+		}
+	}
+}
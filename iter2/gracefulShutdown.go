@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -102,9 +106,20 @@ type Server interface {
 	ReloadConfig(cfg Config) error
 }
 
+// ReloadHook получает результат каждой перезагрузки конфига из файла: новый конфиг или ошибку,
+// при которой сервер продолжает работать со старым конфигом.
+type ReloadHook func(cfg *Config, err error)
+
 type ServerEx struct {
 	cfg                *Config
+	configPath         string        // файл, из которого перечитывается конфиг, пустой - конфиг задан в коде
+	watchInterval      time.Duration // период проверки файла конфига на изменения, 0 - только по SIGHUP
+	onReload           ReloadHook
+	reloadMu           *sync.Mutex // перезагрузки по SIGHUP и по изменению файла не должны идти одновременно
 	server             *http.Server
+	listener           *sharedListener
+	workers            int           // сколько worker-ов запущено, при уменьшении cfg.Workers лишние завершаются сами
+	resized            chan struct{} // закрывается и пересоздается при смене cfg.Workers, будит свободных worker-ов
 	serverHandlers     *http.ServeMux
 	serverContext      context.Context
 	serverCancel       context.CancelFunc
@@ -129,27 +144,155 @@ func NewServer(cfg *Config, h map[string]HandlerWithContext) (*ServerEx, error)
 		registeredHandlers: h,
 		workerPool:         workerPool,
 		mu:                 &sync.RWMutex{},
+		reloadMu:           &sync.Mutex{},
 		wg:                 &sync.WaitGroup{},
 		serverHandlers:     mux,
+		onReload:           logReload,
+		resized:            make(chan struct{}),
+	}
+
+	return serv, nil
+}
+
+// NewServerFromFile создает сервер с конфигом из YAML-файла. Сервер запоминает путь к файлу
+// и перечитывает его по SIGHUP, а если watchInterval > 0 - еще и при изменении файла.
+func NewServerFromFile(configPath string, watchInterval time.Duration, h map[string]HandlerWithContext) (*ServerEx, error) {
+	cfg, err := NewConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	serv, err := NewServer(cfg, h)
+	if err != nil {
+		return nil, err
 	}
+	serv.configPath = configPath
+	serv.watchInterval = watchInterval
 
 	return serv, nil
 }
 
+// OnReload задает обработчик результатов перезагрузки конфига. По умолчанию результат пишется в лог.
+// Вызывать до Start.
+func (s *ServerEx) OnReload(hook ReloadHook) {
+	if hook == nil {
+		hook = logReload
+	}
+	s.onReload = hook
+}
+
+func logReload(cfg *Config, err error) {
+	if err != nil {
+		log.Println("config reload failed, keeping old config:", err)
+		return
+	}
+	log.Println("config reloaded, listening on", cfg.Addr)
+}
+
+// reloadFromFile перечитывает конфиг из файла и применяет его. При ошибке чтения, разбора или валидации
+// сервер продолжает работать со старым конфигом.
+func (s *ServerEx) reloadFromFile() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if s.configPath == "" {
+		err := errors.New("Error: server was created without config file")
+		s.onReload(nil, err)
+		return err
+	}
+
+	cfg, err := NewConfig(s.configPath)
+	if err == nil {
+		err = s.ReloadConfig(*cfg)
+	}
+	if err != nil {
+		s.onReload(nil, err)
+		return err
+	}
+
+	s.onReload(cfg, nil)
+	return nil
+}
+
+// watchConfig раз в watchInterval сравнивает содержимое файла конфига с прочитанным в прошлый раз
+// и перечитывает конфиг, если файл изменился. Время изменения и размер для этого не годятся:
+// запись того же размера в пределах одного тика часов файловой системы их не меняет.
+func (s *ServerEx) watchConfig(last []byte) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.serverContext.Done():
+			return
+		case <-ticker.C:
+		}
+
+		content, err := os.ReadFile(s.configPath)
+		if err != nil {
+			// файл могут заменять через удаление и создание заново - дождемся следующей проверки
+			continue
+		}
+		if bytes.Equal(content, last) {
+			continue
+		}
+		last = content
+		s.reloadFromFile()
+	}
+}
+
 func (s *ServerEx) serverWorker() {
 	defer s.wg.Done()
 	for {
+		s.mu.Lock()
+		if s.workers > s.cfg.Workers {
+			// после перезагрузки конфига worker-ов стало меньше
+			s.workers--
+			s.mu.Unlock()
+			return
+		}
+		resized := s.resized
+		s.mu.Unlock()
+
 		select {
 		case <-s.serverContext.Done():
 			return
+		case <-resized:
 		case task := <-s.workerPool:
-			task.handler(task.ctx, task.wr, task.r)
-		default:
+			// задачу отмененного запроса или остановленного сервера выполнять незачем
+			if task.ctx.Err() == nil && s.serverContext.Err() == nil && task.state.CompareAndSwap(taskQueued, taskRunning) {
+				task.handler(task.ctx, task.wr, task.r)
+			}
+			close(task.done)
 		}
 	}
 }
 
+// startWorkers доводит количество worker-ов до cfg.Workers: недостающие запускаются, а лишние
+// просыпаются и завершаются. Вызывать под s.mu.
+func (s *ServerEx) startWorkers() {
+	for ; s.workers < s.cfg.Workers; s.workers++ {
+		s.wg.Add(1)
+		go s.serverWorker()
+	}
+	close(s.resized)
+	s.resized = make(chan struct{})
+}
+
+// newHTTPServer создает http.Server с таймаутами из конфига.
+func (s *ServerEx) newHTTPServer(cfg *Config) *http.Server {
+	return &http.Server{
+		Addr:         cfg.Addr,
+		Handler:      s.serverHandlers,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+	}
+}
+
 func (s *ServerEx) processServerSignal(sigChan chan os.Signal) {
+	defer signal.Stop(sigChan)
 	for {
 		select {
 		case signal := <-sigChan:
@@ -163,44 +306,43 @@ func (s *ServerEx) processServerSignal(sigChan chan os.Signal) {
 					s.Stop(context.Background())
 				}()
 			case syscall.SIGHUP:
-				// непонятно, откуда получать конфиг
-				s.ReloadConfig(Config{Addr: "localhost:8080", ReadTimeout: 1 * time.Second, WriteTimeout: 2 * time.Second, Workers: 3})
+				s.reloadFromFile()
 			}
 		case <-s.serverContext.Done():
 			return
-		default:
 		}
 	}
 }
 
 func (s *ServerEx) Start() error {
 
-	for i := 0; i < s.cfg.Workers; i++ {
-		s.wg.Add(1)
-		go s.serverWorker()
+	listener, err := newSharedListener(s.cfg.Addr)
+	if err != nil {
+		return err
 	}
 
-	server := &http.Server{
-		Addr:         s.cfg.Addr,
-		Handler:      s.serverHandlers,
-		ReadTimeout:  s.cfg.ReadTimeout,
-		WriteTimeout: s.cfg.WriteTimeout,
-	}
+	server := s.newHTTPServer(s.cfg)
 
+	s.mu.Lock()
+	s.listener = listener
 	s.server = server
+	s.startWorkers()
+	s.mu.Unlock()
 
-	go func() {
-		err := server.ListenAndServe()
-		if err != nil {
-			return
-		}
-	}()
+	go server.Serve(listener.handoff())
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGTERM)
 
 	go s.processServerSignal(sigChan)
 
+	if s.configPath != "" && s.watchInterval > 0 {
+		// содержимое читается до запуска watcher-а, чтобы изменения сразу после Start не потерялись
+		content, _ := os.ReadFile(s.configPath)
+		s.wg.Add(1)
+		go s.watchConfig(content)
+	}
+
 	return nil
 }
 
@@ -209,8 +351,16 @@ type Task struct {
 	wr      http.ResponseWriter
 	r       *http.Request
 	handler HandlerWithContext
+	done    chan struct{} // закрывается worker-ом, когда handler отработал или задача пропущена
+	state   *atomic.Int32 // taskQueued, taskRunning или taskAbandoned
 }
 
+const (
+	taskQueued    int32 = iota // задача ждет worker-а в очереди
+	taskRunning                // worker выполняет handler
+	taskAbandoned              // запрос завершился раньше, чем worker взял задачу, - worker ее пропустит
+)
+
 func (s *ServerEx) RegisterHandler(path string, handler HandlerWithContext) error {
 	// проверяем, существует ли уже handler
 	s.mu.RLock()
@@ -228,12 +378,28 @@ func (s *ServerEx) RegisterHandler(path string, handler HandlerWithContext) erro
 	// в качестве handler заводим функцию, которая будет записывать задачи в канал 
 	// для горутин или завершаться по контексту. 
 	s.serverHandlers.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-		for {
-			select {
-			case s.workerPool <- Task{r.Context(), w, r, handler}:
-			case <-s.serverContext.Done():
+		// контекст задачи отменяется и при отмене запроса клиентом, и при остановке сервера
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		stop := context.AfterFunc(s.serverContext, cancel)
+		defer stop()
+
+		task := Task{ctx, w, r, handler, make(chan struct{}), &atomic.Int32{}}
+		select {
+		case s.workerPool <- task:
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case <-task.done:
+		case <-ctx.Done():
+			if task.state.CompareAndSwap(taskQueued, taskAbandoned) {
+				// worker еще не взял задачу и уже не возьмет
 				return
 			}
+			// ResponseWriter нельзя использовать после выхода из handler-а, поэтому ждем worker
+			<-task.done
 		}
 	})
 	s.mu.Unlock()
@@ -241,6 +407,10 @@ func (s *ServerEx) RegisterHandler(path string, handler HandlerWithContext) erro
 	return nil
 }
 
+// ReloadConfig применяет новый конфиг без остановки приема соединений. Новый http.Server начинает
+// принимать соединения раньше, чем старый перестает, а старый завершает начатые запросы в фоне.
+// Если адрес не изменился, новый сервер принимает соединения с того же listener-а, иначе сначала
+// занимается новый адрес, и при ошибке сервер продолжает работать со старым конфигом.
 func (s *ServerEx) ReloadConfig(cfg Config) error {
 
 	err := cfg.Validate()
@@ -248,42 +418,147 @@ func (s *ServerEx) ReloadConfig(cfg Config) error {
 		return err
 	}
 
-	server := &http.Server{
-		Addr:         cfg.Addr,
-		Handler:      s.serverHandlers,
-		ReadTimeout:  cfg.ReadTimeout,
-		WriteTimeout: cfg.WriteTimeout,
+	if s.serverContext.Err() != nil {
+		return errors.New("Error: server is stopped")
 	}
 
-	errChan := make(chan error, 1)
-	go func() {
-		errChan <- server.ListenAndServe()
-		close(errChan)
-	}()
+	s.mu.RLock()
+	listener := s.listener
+	sameAddr := cfg.Addr == s.cfg.Addr
+	s.mu.RUnlock()
+	if listener == nil {
+		return errors.New("Error: server is not started")
+	}
 
-	select {
-	case <-errChan:
-		return err
-	case <-time.After(1 * time.Second):
+	if !sameAddr {
+		listener, err = newSharedListener(cfg.Addr)
+		if err != nil {
+			return err
+		}
 	}
 
+	server := s.newHTTPServer(&cfg)
+	go server.Serve(listener.handoff())
+
 	s.mu.Lock()
-	s.server.Shutdown(context.Background())
+	oldServer, oldListener := s.server, s.listener
 	s.cfg = &cfg
 	s.server = server
+	s.listener = listener
+	s.startWorkers()
 	s.mu.Unlock()
 
+	go func() {
+		oldServer.Shutdown(context.Background())
+		if !sameAddr {
+			oldListener.Close()
+		}
+	}()
+
 	return nil
 }
 
 func (s *ServerEx) Stop(ctx context.Context) error {
 	s.serverCancel()
 
-	s.server.Shutdown(ctx)
+	s.mu.RLock()
+	server, listener := s.server, s.listener
+	s.mu.RUnlock()
+
+	if server != nil {
+		server.Shutdown(ctx)
+		listener.Close()
+	}
 
+	// workerPool не закрывается: worker-ы завершаются по serverContext, а отправка в закрытый канал
+	// из запоздавшего handler-а или повторный Stop закончились бы паникой
 	s.wg.Wait()
 
-	close(s.workerPool)
+	return nil
+}
+
+// sharedListener слушает адрес сервера и раздает принятые соединения http.Server-ам через handoff.
+// При перезагрузке конфига с тем же адресом новый сервер берет соединения с того же listener-а,
+// поэтому адрес не освобождается и не занимается повторно.
+type sharedListener struct {
+	net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	once  *sync.Once
+}
+
+func newSharedListener(addr string) (*sharedListener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sl := &sharedListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		once:     &sync.Once{},
+	}
+	go sl.accept()
+
+	return sl, nil
+}
+
+func (sl *sharedListener) accept() {
+	for {
+		conn, err := sl.Listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// например, кончились файловые дескрипторы - пробуем снова чуть позже
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
 
+		select {
+		case sl.conns <- conn:
+		case <-sl.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Close перестает слушать адрес: при остановке сервера или после смены адреса.
+func (sl *sharedListener) Close() error {
+	sl.once.Do(func() { close(sl.done) })
+	return sl.Listener.Close()
+}
+
+// handoff возвращает listener для одного http.Server. Его закрывает http.Server.Shutdown,
+// и это останавливает прием соединений только этим сервером.
+func (sl *sharedListener) handoff() net.Listener {
+	return &handoffListener{shared: sl, closed: make(chan struct{}), once: &sync.Once{}}
+}
+
+type handoffListener struct {
+	shared *sharedListener
+	closed chan struct{}
+	once   *sync.Once
+}
+
+func (hl *handoffListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-hl.shared.conns:
+		return conn, nil
+	case <-hl.closed:
+		return nil, net.ErrClosed
+	case <-hl.shared.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (hl *handoffListener) Close() error {
+	hl.once.Do(func() { close(hl.closed) })
 	return nil
 }
+
+func (hl *handoffListener) Addr() net.Addr {
+	return hl.shared.Addr()
+}
@@ -0,0 +1,248 @@
+package main
+
+// Тесты запускаются вместе с файлом сервера:
+//
+//	go test -race iter2/gracefulShutdown.go iter2/gracefulShutdown_test.go
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type reloadResult struct {
+	cfg *Config
+	err error
+}
+
+// freeAddr возвращает свободный локальный адрес.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startServer запускает сервер с конфигом из файла и handler-ом /ping. Результаты перезагрузок
+// конфига приходят в возвращаемый канал.
+func startServer(t *testing.T, config string, watchInterval time.Duration) (*ServerEx, string, chan reloadResult) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, config)
+
+	serv, err := NewServerFromFile(path, watchInterval, map[string]HandlerWithContext{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloads := make(chan reloadResult, 10)
+	serv.OnReload(func(cfg *Config, err error) { reloads <- reloadResult{cfg, err} })
+	err = serv.RegisterHandler("/ping", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { serv.Stop(context.Background()) })
+	return serv, path, reloads
+}
+
+func sighup(t *testing.T) {
+	t.Helper()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitReload(t *testing.T, reloads chan reloadResult) reloadResult {
+	t.Helper()
+	select {
+	case result := <-reloads:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("config was not reloaded")
+		return reloadResult{}
+	}
+}
+
+func ping(t *testing.T, addr string) {
+	t.Helper()
+	resp, err := http.Get("http://" + addr + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "pong" {
+		t.Fatalf("want 200 pong, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func runningWorkers(s *ServerEx) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.workers
+}
+
+func TestSIGHUPReloadsConfigOnSameAddr(t *testing.T) {
+	addr := freeAddr(t)
+	serv, path, reloads := startServer(t, fmt.Sprintf("addr: %s\nworkers: 2\n", addr), 0)
+	ping(t, addr)
+
+	// адрес тот же, меняются только таймауты и количество worker-ов
+	writeConfig(t, path, fmt.Sprintf("addr: %s\nread_timeout: 5s\nwrite_timeout: 5s\nworkers: 4\n", addr))
+	sighup(t)
+	result := waitReload(t, reloads)
+	if result.err != nil {
+		t.Fatalf("reload with the same addr failed: %v", result.err)
+	}
+	if result.cfg.WriteTimeout != 5*time.Second || result.cfg.Workers != 4 {
+		t.Fatalf("want new timeouts and workers, got %+v", result.cfg)
+	}
+	if workers := runningWorkers(serv); workers != 4 {
+		t.Fatalf("want 4 workers, got %d", workers)
+	}
+	ping(t, addr)
+
+	writeConfig(t, path, fmt.Sprintf("addr: %s\nworkers: 1\n", addr))
+	sighup(t)
+	if result := waitReload(t, reloads); result.err != nil {
+		t.Fatal(result.err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runningWorkers(serv) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want extra workers to stop, got %d", runningWorkers(serv))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ping(t, addr)
+}
+
+func TestSIGHUPInvalidConfigKeepsOldConfig(t *testing.T) {
+	addr := freeAddr(t)
+	serv, path, reloads := startServer(t, fmt.Sprintf("addr: %s\nworkers: 2\n", addr), 0)
+
+	for _, config := range []string{
+		"addr: [",
+		fmt.Sprintf("addr: %s\nworkers: 0\n", addr),
+	} {
+		writeConfig(t, path, config)
+		sighup(t)
+		if result := waitReload(t, reloads); result.err == nil {
+			t.Fatalf("want reload of %q to fail", config)
+		}
+		serv.mu.RLock()
+		cfg := *serv.cfg
+		serv.mu.RUnlock()
+		if cfg.Addr != addr || cfg.Workers != 2 {
+			t.Fatalf("want old config to stay, got %+v", cfg)
+		}
+		ping(t, addr)
+	}
+}
+
+func TestConfigFileChangeReloadsConfig(t *testing.T) {
+	addr := freeAddr(t)
+	_, path, reloads := startServer(t, fmt.Sprintf("addr: %s\nworkers: 2\n", addr), 10*time.Millisecond)
+
+	newAddr := freeAddr(t)
+	writeConfig(t, path, fmt.Sprintf("addr: %s\nworkers: 3\n", newAddr))
+	result := waitReload(t, reloads)
+	if result.err != nil || result.cfg.Addr != newAddr || result.cfg.Workers != 3 {
+		t.Fatalf("want config with the new addr, got %+v, %v", result.cfg, result.err)
+	}
+	ping(t, newAddr)
+
+	// старый адрес освобождается после перехода на новый
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			l.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("old addr is still in use: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStopWithQueuedRequest(t *testing.T) {
+	addr := freeAddr(t)
+	serv, _, _ := startServer(t, fmt.Sprintf("addr: %s\nworkers: 1\n", addr), 0)
+
+	started := make(chan struct{})
+	var queuedRan atomic.Bool
+	err := serv.RegisterHandler("/poll", func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("queued") != "" {
+			queuedRan.Store(true)
+			return
+		}
+		close(started)
+		// long polling: отвечаем, только когда сервер останавливается
+		<-ctx.Done()
+		io.WriteString(w, "stopped")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	polled := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/poll")
+		if err != nil {
+			polled <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		polled <- string(body)
+	}()
+	<-started
+
+	// единственный worker занят, второй запрос ждет в очереди
+	go http.Get("http://" + addr + "/poll?queued=1")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(serv.workerPool) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("second request was not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	start := time.Now()
+	serv.Stop(ctx)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Stop waited %v for the queued request", elapsed)
+	}
+	if body := <-polled; body != "stopped" {
+		t.Fatalf("want long polling request to be notified through context, got %q", body)
+	}
+	if queuedRan.Load() {
+		t.Fatal("queued request ran after Stop")
+	}
+}
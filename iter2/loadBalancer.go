@@ -1,8 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"container/heap"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -42,60 +57,474 @@ type Backend interface {
 
 type BackendImpl struct {
 	addr        string
-	active      bool
-	amountOfReq int
-	mu          *sync.RWMutex
+	transport   Transport
+	active      bool          // бэкенд участвует в балансировке
+	amountOfReq int           // количество запросов в работе
+	failures    int           // ошибки живого трафика подряд
+	index       int           // позиция в куче балансировщика, -1 - бэкенд исключен из балансировки
+	pickedAt    uint64        // номер последнего выбора бэкенда, по нему делятся запросы между одинаково загруженными
+	removed     bool          // бэкенд удаляется из балансировщика и ждет завершения запросов
+	limit       float64       // адаптивный лимит запросов в работе
+	minLatency  time.Duration // latency без нагрузки, от нее считается перегрузка бэкенда
+	drained     chan struct{} // закрывается, когда у удаляемого бэкенда не осталось запросов в работе
+	cost        float64       // peak-EWMA latency в наносекундах, см. BalancerConfig.PeakEWMA
+	costAt      time.Time     // время последнего обновления cost
+	// результаты активных health-check-ов
+	checkSuccesses int // успешные проверки подряд
+	checkFailures  int // неудачные проверки подряд
+	lastCheckAt    time.Time
+	lastErr        error // последняя ошибка живого трафика или health-check-а
+	lastErrAt      time.Time
 }
 
 var _ Backend = &BackendImpl{}
 
 func NewBackend(addr string) *BackendImpl {
-	return &BackendImpl{addr: addr, active: true, amountOfReq: 0, mu: &sync.RWMutex{}}
+	return NewBackendWithTransport(addr, NewHTTPTransport(nil))
+}
+
+func NewBackendWithTransport(addr string, transport Transport) *BackendImpl {
+	return &BackendImpl{addr: addr, transport: transport, active: true, amountOfReq: 0, index: -1}
 }
 
 func (back *BackendImpl) Invoke(ctx context.Context, req Request) (Response, error) {
-	return nil, nil
+	return back.transport.Send(ctx, back.addr, req)
 }
 
-func (back *BackendImpl) HealthCheck(ctx context.Context, req Request, stopChannel chan struct{}, syncChannel chan *BackendImpl, wg *sync.WaitGroup) {
-	back.mu.Lock()
-	back.active = false
-	back.amountOfReq = 0
-	back.mu.Unlock()
-	defer wg.Done()
+func (back *BackendImpl) HealthCheck(ctx context.Context) error {
+	_, err := back.Invoke(ctx, healthCheckRequest{})
+	return err
+}
 
-	ticker := time.NewTicker(1000 * time.Millisecond)
-	defer ticker.Stop()
+// Transport отправляет запрос конкретному экземпляру микросервиса по его адресу.
+// BackendImpl отвечает только за учет состояния экземпляра, а сетевое взаимодействие делегирует транспорту.
+type Transport interface {
+	Send(ctx context.Context, addr string, req Request) (Response, error)
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			_, err := back.Invoke(ctx, req)
-			if err == nil {
-				back.mu.Lock()
-				back.active = true
-				back.amountOfReq = 0
-				back.mu.Unlock()
-				syncChannel <- back
-				return
+// HTTPResponse - ответ экземпляра, который возвращает HTTPTransport.
+type HTTPResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// BackendHTTPError - экземпляр ответил статусом 4xx/5xx.
+type BackendHTTPError struct {
+	Addr       string
+	StatusCode int
+	Body       []byte
+}
+
+func (e *BackendHTTPError) Error() string {
+	return fmt.Sprintf("backend %s responded with status %d", e.Addr, e.StatusCode)
+}
+
+// RequestError - запрос не удалось собрать (например, Request не кодируется в JSON). Запрос не дошел
+// до бэкенда, поэтому такая ошибка не повторяется и не учитывается как сбой бэкенда.
+type RequestError struct {
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("invalid request: %v", e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// HTTPTransport отправляет Request на addr по HTTP.
+// []byte и string отправляются как есть, *http.Request - с подменой хоста на addr, остальное кодируется в JSON.
+// healthCheckRequest отправляется GET-запросом на HealthPath.
+type HTTPTransport struct {
+	Client     *http.Client
+	Scheme     string // по умолчанию http
+	Method     string // по умолчанию POST
+	Path       string
+	HealthPath string // по умолчанию /health
+}
+
+var _ Transport = &HTTPTransport{}
+
+func NewHTTPTransport(client *http.Client) *HTTPTransport {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPTransport{Client: client, Scheme: "http", Method: http.MethodPost, HealthPath: "/health"}
+}
+
+func (t *HTTPTransport) Send(ctx context.Context, addr string, req Request) (Response, error) {
+	httpReq, err := t.buildRequest(ctx, addr, req)
+	if err != nil {
+		return nil, &RequestError{Err: err}
+	}
+
+	httpResp, err := t.Client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &HTTPResponse{StatusCode: httpResp.StatusCode, Header: httpResp.Header, Body: body}
+	if httpResp.StatusCode >= 400 {
+		return resp, &BackendHTTPError{Addr: addr, StatusCode: httpResp.StatusCode, Body: body}
+	}
+	return resp, nil
+}
+
+func (t *HTTPTransport) buildRequest(ctx context.Context, addr string, req Request) (*http.Request, error) {
+	scheme := t.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	method := t.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	target := url.URL{Scheme: scheme, Host: addr, Path: t.Path}
+
+	var body []byte
+	contentType := ""
+	switch r := req.(type) {
+	case healthCheckRequest:
+		target.Path = t.HealthPath
+		return http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	case *http.Request:
+		// Clone не копирует тело, а первая попытка вычитывает его до конца,
+		// поэтому каждая попытка получает свою копию тела через GetBody
+		if err := replayableBody(r); err != nil {
+			return nil, err
+		}
+		httpReq := r.Clone(ctx)
+		if r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
 			}
-		case <-stopChannel:
-			return
+			httpReq.Body = body
+		}
+		httpReq.URL.Scheme = scheme
+		httpReq.URL.Host = addr
+		httpReq.Host = addr
+		httpReq.RequestURI = ""
+		return httpReq, nil
+	case []byte:
+		body = r
+	case string:
+		body = []byte(r)
+	default:
+		encoded, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		body = encoded
+		contentType = "application/json"
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	return httpReq, nil
+}
+
+// replayableBody буферизует тело запроса, для которого не задан GetBody (например, тело из io.Reader
+// произвольного типа), и задает GetBody, чтобы тело можно было отправить повторно.
+func replayableBody(r *http.Request) error {
+	if r.GetBody != nil || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	r.ContentLength = int64(len(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return nil
+}
+
+// FakeStep - один шаг сценария FakeTransport: задержка перед ответом и результат.
+type FakeStep struct {
+	Latency  time.Duration
+	Response Response
+	Err      error
+}
+
+// FakeTransport - транспорт для тестов со сценарием ответов для каждого адреса.
+// Шаги сценария выполняются по очереди, последний шаг повторяется. Задержка прерывается отменой контекста.
+type FakeTransport struct {
+	scripts map[string][]FakeStep
+	calls   map[string]int
+	mu      *sync.Mutex
+}
+
+var _ Transport = &FakeTransport{}
+
+func NewFakeTransport() *FakeTransport {
+	return &FakeTransport{
+		scripts: make(map[string][]FakeStep),
+		calls:   make(map[string]int),
+		mu:      &sync.Mutex{},
+	}
+}
+
+// Script задает сценарий ответов для addr. Адрес без сценария отвечает сразу и без ошибки.
+func (t *FakeTransport) Script(addr string, steps ...FakeStep) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.scripts[addr] = steps
+}
+
+// Calls возвращает количество запросов, отправленных на addr.
+func (t *FakeTransport) Calls(addr string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.calls[addr]
+}
+
+func (t *FakeTransport) Send(ctx context.Context, addr string, req Request) (Response, error) {
+	t.mu.Lock()
+	step := FakeStep{}
+	if script := t.scripts[addr]; len(script) > 0 {
+		step = script[0]
+		if len(script) > 1 {
+			t.scripts[addr] = script[1:]
+		}
+	}
+	t.calls[addr]++
+	t.mu.Unlock()
+
+	if step.Latency > 0 {
+		timer := time.NewTimer(step.Latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
 		case <-ctx.Done():
-			return
-		default:
+			return nil, ctx.Err()
+		}
+	}
+	return step.Response, step.Err
+}
+
+// backendHeap - min-куча активных бэкендов по количеству запросов в работе.
+// Наименее загруженный бэкенд всегда лежит в корне, поэтому выбор занимает O(1),
+// а обновление счетчика после начала и завершения запроса - O(log n).
+// Из одинаково загруженных бэкендов в корне оказывается тот, который дольше всех не выбирали,
+// поэтому при равной нагрузке запросы расходятся по кругу.
+type backendHeap []*BackendImpl
+
+func (h backendHeap) Len() int { return len(h) }
+
+func (h backendHeap) Less(i, j int) bool { return lessLoaded(h[i], h[j]) }
+
+func lessLoaded(a, b *BackendImpl) bool {
+	if a.amountOfReq != b.amountOfReq {
+		return a.amountOfReq < b.amountOfReq
+	}
+	return a.pickedAt < b.pickedAt
+}
+
+func (h backendHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *backendHeap) Push(x any) {
+	backend := x.(*BackendImpl)
+	backend.index = len(*h)
+	*h = append(*h, backend)
+}
+
+func (h *backendHeap) Pop() any {
+	old := *h
+	backend := old[len(old)-1]
+	old[len(old)-1] = nil
+	backend.index = -1
+	*h = old[:len(old)-1]
+	return backend
+}
+
+type BalancerConfig struct {
+	Transport   Transport        // по умолчанию HTTPTransport с http.DefaultClient
+	MaxAttempts int              // всего попыток на один вызов Invoke, по умолчанию 3
+	MaxFails    int              // ошибок подряд, после которых бэкенд исключается из балансировки, по умолчанию 3
+	BaseBackoff time.Duration    // задержка перед первым retry, по умолчанию 50ms
+	MaxBackoff  time.Duration    // по умолчанию 2s
+	IsRetryable func(error) bool // по умолчанию IsRetryableError
+
+	HealthCheckInterval time.Duration // период активных health-check-ов, по умолчанию 1s
+	HealthCheckTimeout  time.Duration // по умолчанию 500ms
+	HealthyThreshold    int           // успешных проверок подряд, чтобы вернуть бэкенд в балансировку, по умолчанию 2
+	UnhealthyThreshold  int           // неудачных проверок подряд, чтобы исключить бэкенд, по умолчанию 3
+	// HealthPath - путь, который проверяет HTTPTransport по умолчанию, по умолчанию /health.
+	// Бэкенд, который не отвечает на него статусом ниже 400, исключается из балансировки.
+	// Если задан свой Transport, путь проверки задается в нем (см. HTTPTransport.HealthPath)
+	HealthPath string
+
+	DrainTimeout time.Duration // сколько WatchBackendsFile ждет завершения запросов удаляемых бэкендов, по умолчанию 30s
+
+	MaxInFlight int // жесткий лимит запросов в работе на один бэкенд, 0 - без лимита
+	// AdaptiveLimit включает AIMD-лимит запросов в работе для каждого бэкенда: лимит растет на 1/limit
+	// после каждого быстрого успешного запроса и умножается на 0.9 после ошибки или запроса,
+	// который выполнялся дольше LatencyTolerance * latency без нагрузки
+	AdaptiveLimit    bool
+	InitialLimit     int     // по умолчанию 20
+	MinLimit         int     // по умолчанию 1
+	MaxLimit         int     // по умолчанию 1000
+	LatencyTolerance float64 // по умолчанию 2
+	// QueueSize - сколько вызовов может ждать освободившуюся емкость, когда все бэкенды заняты.
+	// 0 - сразу возвращать ErrOverloaded
+	QueueSize int
+
+	// HashKey достает из запроса ключ для sticky-маршрутизации (например, id пользователя).
+	// Запросы с ключом идут через consistent hashing на один и тот же бэкенд, пока он здоров.
+	// По умолчанию ключ берется из контекста, см. WithHashKey
+	HashKey      func(ctx context.Context, req Request) (string, bool)
+	VirtualNodes int // количество точек каждого бэкенда на кольце, по умолчанию 100
+
+	// PeakEWMA включает выбор бэкенда по score = peak-EWMA latency * (запросов в работе + 1) вместо
+	// количества запросов в работе. Медленная попытка сразу поднимает latency бэкенда до своего значения,
+	// а быстрые снижают ее плавно. Без трафика latency затухает к нулю с постоянной DecayTime,
+	// поэтому восстановившийся бэкенд снова получает запросы
+	PeakEWMA  bool
+	DecayTime time.Duration // по умолчанию 10s
+}
+
+type hashKeyCtx struct{}
+
+// WithHashKey кладет в контекст ключ для sticky-маршрутизации запроса.
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyCtx{}, key)
+}
+
+func hashKeyFromContext(ctx context.Context, req Request) (string, bool) {
+	key, ok := ctx.Value(hashKeyCtx{}).(string)
+	return key, ok && key != ""
+}
+
+// ringPoint - точка бэкенда на кольце consistent hashing-а.
+type ringPoint struct {
+	hash    uint64
+	backend *BackendImpl
+}
+
+func ringHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// финализатор splitmix64: у FNV плохо перемешиваются похожие строки вида addr#1, addr#2
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// ErrOverloaded возвращается, когда у всех бэкендов исчерпан лимит запросов в работе, а очередь ожидания
+// заполнена или вызов не дождался емкости до отмены контекста (тогда ошибка оборачивает и ошибку контекста).
+var ErrOverloaded = errors.New("All backends are overloaded")
+
+type BackendState int
+
+const (
+	BackendHealthy BackendState = iota
+	BackendUnhealthy
+	BackendDraining
+)
+
+func (s BackendState) String() string {
+	switch s {
+	case BackendHealthy:
+		return "healthy"
+	case BackendDraining:
+		return "draining"
+	}
+	return "unhealthy"
+}
+
+// BackendStatus - состояние бэкенда, которое возвращает Balancer.Backends.
+type BackendStatus struct {
+	Addr        string
+	State       BackendState
+	InFlight    int
+	Limit       int // текущий лимит запросов в работе, 0 - без лимита
+	Failures    int // ошибки живого трафика подряд
+	LastCheckAt time.Time
+	LastErr     error
+	LastErrAt   time.Time
+}
+
+// AttemptError - ошибка одной попытки вызова.
+type AttemptError struct {
+	Addr string
+	Err  error
+}
+
+// InvokeError возвращается из Balancer.Invoke, когда ни одна попытка не удалась, и содержит ошибки всех попыток.
+type InvokeError struct {
+	Attempts []AttemptError
+}
+
+func (e *InvokeError) Error() string {
+	parts := make([]string, 0, len(e.Attempts))
+	for idx, attempt := range e.Attempts {
+		if attempt.Addr == "" {
+			parts = append(parts, fmt.Sprintf("attempt %d: %v", idx+1, attempt.Err))
+			continue
 		}
+		parts = append(parts, fmt.Sprintf("attempt %d (%s): %v", idx+1, attempt.Addr, attempt.Err))
+	}
+	return fmt.Sprintf("all %d attempts failed: %s", len(e.Attempts), strings.Join(parts, "; "))
+}
+
+func (e *InvokeError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Attempts))
+	for _, attempt := range e.Attempts {
+		errs = append(errs, attempt.Err)
 	}
+	return errs
+}
+
+// IsRetryableError - классификация ошибок по умолчанию. Повторять имеет смысл сетевые ошибки, 429 и 5xx,
+// а ошибки клиента (остальные 4xx и RequestError) и отмену запроса вызывающим повторять бессмысленно.
+func IsRetryableError(err error) bool {
+	var reqErr *RequestError
+	if errors.Is(err, context.Canceled) || errors.As(err, &reqErr) {
+		return false
+	}
+	var httpErr *BackendHTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode >= 500
+	}
+	return true
 }
 
 type Balancer struct {
-	backends    map[*BackendImpl]struct{}
-	mu          *sync.RWMutex
-	next        *BackendImpl
-	syncChannel chan *BackendImpl
-	stopChannel chan struct{}
-	wg          *sync.WaitGroup
-	minReq      int
+	cfg      BalancerConfig
+	members  []*BackendImpl // все бэкенды, в том числе исключенные из балансировки
+	backends backendHeap    // только бэкенды, участвующие в балансировке
+	mu       *sync.Mutex
+	ctx      context.Context // живет до Stop, от него создаются контексты health-check-ов
+	cancel   context.CancelFunc
+	wg       *sync.WaitGroup
+	waiters  []chan struct{} // вызовы, которые ждут освободившуюся емкость, в порядке очереди
+	ring     []ringPoint     // кольцо consistent hashing-а, отсортировано по hash
+	picks    uint64          // счетчик выборов бэкендов, см. BackendImpl.pickedAt
 }
 
 // Balancer удовлетворяет интерфейсу Backend-а
@@ -103,143 +532,748 @@ var _ Backend = &Balancer{}
 
 // addrs содержат адреса всех балансируемых экземпляров
 func NewBalancer(addrs []string) *Balancer {
-	backends := make(map[*BackendImpl]struct{}, 0)
-	syncChannel := make(chan *BackendImpl, len(addrs))
-	stopChannel := make(chan struct{})
-	minReq := 0
-	wg := &sync.WaitGroup{}
-	mu := &sync.RWMutex{}
-
-	firstBackend := NewBackend(addrs[0])
+	return NewBalancerWithConfig(addrs, BalancerConfig{})
+}
+
+func NewBalancerWithConfig(addrs []string, cfg BalancerConfig) *Balancer {
+	if cfg.Transport == nil {
+		transport := NewHTTPTransport(nil)
+		if cfg.HealthPath != "" {
+			transport.HealthPath = cfg.HealthPath
+		}
+		cfg.Transport = transport
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 3
+	}
+	if cfg.MaxFails <= 0 {
+		cfg.MaxFails = 3
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = 50 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.BaseBackoff {
+		cfg.MaxBackoff = max(2*time.Second, cfg.BaseBackoff)
+	}
+	if cfg.IsRetryable == nil {
+		cfg.IsRetryable = IsRetryableError
+	}
+	if cfg.HealthCheckInterval <= 0 {
+		cfg.HealthCheckInterval = time.Second
+	}
+	if cfg.HealthCheckTimeout <= 0 {
+		cfg.HealthCheckTimeout = 500 * time.Millisecond
+	}
+	if cfg.HealthyThreshold <= 0 {
+		cfg.HealthyThreshold = 2
+	}
+	if cfg.UnhealthyThreshold <= 0 {
+		cfg.UnhealthyThreshold = 3
+	}
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = 30 * time.Second
+	}
+	if cfg.MinLimit <= 0 {
+		cfg.MinLimit = 1
+	}
+	if cfg.MaxLimit < cfg.MinLimit {
+		cfg.MaxLimit = max(1000, cfg.MinLimit)
+	}
+	if cfg.InitialLimit <= 0 {
+		cfg.InitialLimit = 20
+	}
+	cfg.InitialLimit = min(max(cfg.InitialLimit, cfg.MinLimit), cfg.MaxLimit)
+	if cfg.LatencyTolerance <= 1 {
+		cfg.LatencyTolerance = 2
+	}
+	if cfg.HashKey == nil {
+		cfg.HashKey = hashKeyFromContext
+	}
+	if cfg.VirtualNodes <= 0 {
+		cfg.VirtualNodes = 100
+	}
+	if cfg.DecayTime <= 0 {
+		cfg.DecayTime = 10 * time.Second
+	}
+
+	members := make([]*BackendImpl, 0, len(addrs))
+	backends := make(backendHeap, 0, len(addrs))
 	for _, addr := range addrs {
-		backend := NewBackend(addr)
-		backends[backend] = struct{}{}
+		backend := NewBackendWithTransport(addr, cfg.Transport)
+		backend.limit = float64(cfg.InitialLimit)
+		members = append(members, backend)
+		heap.Push(&backends, backend)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	balancer := &Balancer{
-		backends:    backends,
-		mu:          mu,
-		next:        firstBackend,
-		syncChannel: syncChannel,
-		stopChannel: stopChannel,
-		wg:          wg,
-		minReq:      minReq,
+		cfg:      cfg,
+		members:  members,
+		backends: backends,
+		mu:       &sync.Mutex{},
+		ctx:      ctx,
+		cancel:   cancel,
+		wg:       &sync.WaitGroup{},
+	}
+	balancer.rebuildRing()
+
+	balancer.wg.Add(1)
+	go balancer.healthCheckLoop()
+
+	return balancer
+}
+
+// healthCheckLoop раз в HealthCheckInterval проверяет все бэкенды, независимо от пользовательских запросов.
+func (b *Balancer) healthCheckLoop() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+			b.mu.Lock()
+			members := slices.Clone(b.members)
+			b.mu.Unlock()
+
+			var wg sync.WaitGroup
+			for _, backend := range members {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ctx, cancel := context.WithTimeout(b.ctx, b.cfg.HealthCheckTimeout)
+					defer cancel()
+					err := backend.HealthCheck(ctx)
+					if b.ctx.Err() == nil {
+						b.recordHealthCheck(backend, err)
+					}
+				}()
+			}
+			wg.Wait()
+		}
 	}
+}
 
-	wg.Add(1)
+// recordHealthCheck учитывает результат активной проверки. Бэкенд исключается после UnhealthyThreshold
+// неудачных проверок подряд и возвращается в балансировку после HealthyThreshold успешных.
+func (b *Balancer) recordHealthCheck(backend *BackendImpl, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if backend.removed {
+		return
+	}
+	backend.lastCheckAt = time.Now()
+	if err != nil {
+		backend.checkSuccesses = 0
+		backend.checkFailures++
+		backend.lastErr = err
+		backend.lastErrAt = backend.lastCheckAt
+		if backend.active && backend.checkFailures >= b.cfg.UnhealthyThreshold {
+			b.deactivate(backend)
+		}
+		return
+	}
+
+	backend.checkFailures = 0
+	backend.checkSuccesses++
+	if !backend.active && backend.checkSuccesses >= b.cfg.HealthyThreshold {
+		backend.active = true
+		backend.failures = 0
+		heap.Push(&b.backends, backend)
+		b.wakeWaiter()
+	}
+}
+
+// deactivate исключает бэкенд из балансировки до успешных health-check-ов. Вызывать под мьютексом.
+func (b *Balancer) deactivate(backend *BackendImpl) {
+	backend.active = false
+	backend.checkSuccesses = 0
+	if backend.index != -1 {
+		heap.Remove(&b.backends, backend.index)
+	}
+}
+
+// member возвращает бэкенд по адресу, в том числе удаляемый. Вызывать под мьютексом.
+func (b *Balancer) member(addr string) *BackendImpl {
+	for _, backend := range b.members {
+		if backend.addr == addr {
+			return backend
+		}
+	}
+	return nil
+}
+
+// AddBackend добавляет экземпляр в балансировку. Экземпляр, который после RemoveBackend еще ждет
+// завершения запросов, не удаляется, а сразу возвращается в балансировку.
+func (b *Balancer) AddBackend(addr string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if backend := b.member(addr); backend != nil {
+		if !backend.removed {
+			return fmt.Errorf("Backend %s already exists", addr)
+		}
+		backend.removed = false
+		backend.active = true
+		backend.failures = 0
+		backend.checkFailures = 0
+		if backend.drained != nil {
+			// RemoveBackend перестает ждать и видит, что экземпляр вернули
+			close(backend.drained)
+			backend.drained = nil
+		}
+		heap.Push(&b.backends, backend)
+		b.rebuildRing()
+		b.wakeWaiter()
+		return nil
+	}
+	backend := NewBackendWithTransport(addr, b.cfg.Transport)
+	backend.limit = float64(b.cfg.InitialLimit)
+	b.members = append(b.members, backend)
+	heap.Push(&b.backends, backend)
+	b.rebuildRing()
+	b.wakeWaiter()
+	return nil
+}
+
+// RemoveBackend сразу перестает отправлять новые запросы на экземпляр и ждет завершения запросов в работе,
+// но не дольше, чем живет ctx. После этого экземпляр удаляется из балансировщика в любом случае,
+// если только за время ожидания его не вернули через AddBackend.
+func (b *Balancer) RemoveBackend(ctx context.Context, addr string) error {
+	b.mu.Lock()
+	backend := b.member(addr)
+	if backend == nil || backend.removed {
+		b.mu.Unlock()
+		return fmt.Errorf("Backend %s not found", addr)
+	}
+	backend.removed = true
+	backend.active = false
+	if backend.index != -1 {
+		heap.Remove(&b.backends, backend.index)
+	}
+	b.rebuildRing()
+	drained := make(chan struct{})
+	if backend.amountOfReq == 0 {
+		close(drained)
+	} else {
+		backend.drained = drained
+	}
+	b.mu.Unlock()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("Backend %s removed with requests in flight: %w", addr, ctx.Err())
+	case <-b.ctx.Done():
+		err = fmt.Errorf("Backend %s removed with requests in flight: balancer stopped", addr)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !backend.removed {
+		return fmt.Errorf("Backend %s was added back while draining", addr)
+	}
+	b.members = slices.DeleteFunc(b.members, func(member *BackendImpl) bool { return member == backend })
+	backend.drained = nil
+
+	return err
+}
+
+// SetBackends приводит список экземпляров к addrs: добавляет новые и удаляет (с ожиданием запросов) отсутствующие.
+func (b *Balancer) SetBackends(ctx context.Context, addrs []string) error {
+	b.mu.Lock()
+	current := make([]string, 0, len(b.members))
+	for _, backend := range b.members {
+		if !backend.removed {
+			current = append(current, backend.addr)
+		}
+	}
+	b.mu.Unlock()
+
+	var errs []error
+	for _, addr := range addrs {
+		if !slices.Contains(current, addr) {
+			if err := b.AddBackend(addr); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, addr := range current {
+		if slices.Contains(addrs, addr) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.RemoveBackend(ctx, addr); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// WatchBackendsFile загружает список экземпляров из файла (один адрес на строку, # - комментарий)
+// и дальше раз в interval перечитывает файл, если список в нем изменился. Файл с ошибкой или пустой файл
+// игнорируется, чтобы недописанный файл не выкинул из балансировки все экземпляры.
+// Interval <= 0 - раз в секунду.
+func (b *Balancer) WatchBackendsFile(path string, interval time.Duration) error {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	addrs, err := readBackendsFile(path)
+	if err != nil {
+		return err
+	}
+	if err := b.applyBackendsFile(addrs); err != nil {
+		return err
+	}
+
+	b.wg.Add(1)
 	go func() {
-		defer wg.Done()
-		ticker := time.NewTicker(10 * time.Millisecond)
+		defer b.wg.Done()
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
 		for {
 			select {
-			case backend, ok := <-syncChannel:
-				if !ok {
-					return
-				}
-				mu.Lock()
-				backends[backend] = struct{}{}
-				mu.Unlock()
+			case <-b.ctx.Done():
+				return
 			case <-ticker.C:
-				balancer.next.mu.RLock()
-				tekBackend := balancer.next
-				balancer.next.mu.RUnlock()
-
-				if !tekBackend.active || (balancer.minReq != tekBackend.amountOfReq) {
-					balancer.mu.RLock()
-					minReqCount := -1
-
-					for back := range balancer.backends {
-						back.mu.RLock()
-						if minReqCount == -1 && back.active {
-							tekBackend = back
-							minReqCount = back.amountOfReq
-						}
-						if minReqCount > back.amountOfReq && back.active {
-							tekBackend = back
-							minReqCount = back.amountOfReq
-						}
-						back.mu.RUnlock()
-					}
-					balancer.mu.RUnlock()
-
-					balancer.mu.Lock()
-					if _, exists := balancer.backends[tekBackend]; exists {
-						balancer.next = tekBackend
-						balancer.minReq = minReqCount
-					}
-					balancer.mu.Unlock()
+				// сравниваем список, а не время изменения файла: запись в пределах одного тика
+				// часов файловой системы время изменения не меняет
+				newAddrs, err := readBackendsFile(path)
+				if err != nil || slices.Equal(newAddrs, addrs) {
+					continue
 				}
-			default:
+				addrs = newAddrs
+				b.applyBackendsFile(newAddrs)
 			}
 		}
 	}()
 
-	return balancer
+	return nil
 }
 
-func (b *Balancer) Invoke(ctx context.Context, req Request) (Response, error) {
+func (b *Balancer) applyBackendsFile(addrs []string) error {
+	ctx, cancel := context.WithTimeout(b.ctx, b.cfg.DrainTimeout)
+	defer cancel()
+	return b.SetBackends(ctx, addrs)
+}
 
-	if len(b.backends) == 0 {
-		return nil, errors.New("No available backends found")
+func readBackendsFile(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
 
-	b.mu.RLock()
-	backend := b.next
-	b.mu.RUnlock()
+	addrs := make([]string, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || slices.Contains(addrs, line) {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("No backends found in %s", path)
+	}
+	return addrs, nil
+}
 
-	backend.mu.Lock()
-	backend.amountOfReq += 1
-	backend.mu.Unlock()
+// Backends возвращает снимок состояния всех бэкендов.
+func (b *Balancer) Backends() []BackendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	resp, err := backend.Invoke(ctx, req)
-	seconds := time.Second
-	counter := 1
+	statuses := make([]BackendStatus, 0, len(b.members))
+	for _, backend := range b.members {
+		state := BackendHealthy
+		switch {
+		case backend.removed:
+			state = BackendDraining
+		case !backend.active:
+			state = BackendUnhealthy
+		}
+		statuses = append(statuses, BackendStatus{
+			Addr:        backend.addr,
+			State:       state,
+			InFlight:    backend.amountOfReq,
+			Limit:       b.limit(backend),
+			Failures:    backend.failures,
+			LastCheckAt: backend.lastCheckAt,
+			LastErr:     backend.lastErr,
+			LastErrAt:   backend.lastErrAt,
+		})
+	}
+	return statuses
+}
+
+// acquire выбирает наименее загруженный бэкенд, у которого есть свободная емкость и на который еще не ходили
+// в рамках этого вызова, и сразу учитывает в нем новый запрос. Если все такие бэкенды уже пробовали,
+// берется наименее загруженный из них. Когда свободной емкости нет, вызов ждет в очереди (если она есть и не заполнена),
+// иначе сразу получает ErrOverloaded.
+func (b *Balancer) acquire(ctx context.Context, key string, tried map[*BackendImpl]struct{}) (*BackendImpl, error) {
 	for {
-		if err == nil {
-			backend.mu.Lock()
-			if backend.active {
-				backend.amountOfReq -= 1
-			}
-			backend.mu.Unlock()
-			break
+		b.mu.Lock()
+		if len(b.backends) == 0 {
+			b.mu.Unlock()
+			return nil, errors.New("No available backends found")
 		}
-		if counter == 3 {
-			break
+
+		backend := b.pickByHash(key, tried)
+		if backend == nil {
+			backend = b.pick(tried)
+		}
+		if backend != nil {
+			b.picks++
+			backend.pickedAt = b.picks
+			backend.amountOfReq++
+			heap.Fix(&b.backends, backend.index)
+			b.mu.Unlock()
+			return backend, nil
 		}
+
+		if len(b.waiters) >= b.cfg.QueueSize {
+			b.mu.Unlock()
+			return nil, ErrOverloaded
+		}
+		waiter := make(chan struct{})
+		b.waiters = append(b.waiters, waiter)
+		b.mu.Unlock()
+
 		select {
+		case <-waiter:
 		case <-ctx.Done():
-			if err != nil {
-				checkReq := healthCheckRequest{}
-				b.wg.Add(1)
-				b.mu.Lock()
-				delete(b.backends, backend)
-				b.mu.Unlock()
-				go backend.HealthCheck(ctx, checkReq, b.stopChannel, b.syncChannel, b.wg)
+			b.cancelWait(waiter)
+			return nil, fmt.Errorf("%w: %w", ErrOverloaded, ctx.Err())
+		case <-b.ctx.Done():
+			b.cancelWait(waiter)
+			return nil, errors.New("Balancer has been stopped")
+		}
+	}
+}
+
+// rebuildRing перестраивает кольцо consistent hashing-а. На кольце остаются и временно исключенные бэкенды,
+// поэтому после восстановления бэкенда к нему возвращаются его ключи, а при добавлении или удалении
+// бэкенда переезжают только ключи его точек. Вызывать под мьютексом.
+func (b *Balancer) rebuildRing() {
+	ring := make([]ringPoint, 0, len(b.members)*b.cfg.VirtualNodes)
+	for _, backend := range b.members {
+		if backend.removed {
+			continue
+		}
+		for i := 0; i < b.cfg.VirtualNodes; i++ {
+			ring = append(ring, ringPoint{hash: ringHash(backend.addr + "#" + strconv.Itoa(i)), backend: backend})
+		}
+	}
+	slices.SortFunc(ring, func(a, b ringPoint) int { return cmp.Compare(a.hash, b.hash) })
+	b.ring = ring
+}
+
+// pickByHash выбирает владельца ключа на кольце. Если владелец исключен из балансировки, перегружен
+// или уже пробовался в этом вызове, берется следующий по кольцу бэкенд. Вызывать под мьютексом.
+func (b *Balancer) pickByHash(key string, tried map[*BackendImpl]struct{}) *BackendImpl {
+	if key == "" || len(b.ring) == 0 {
+		return nil
+	}
+
+	hash := ringHash(key)
+	start, _ := slices.BinarySearchFunc(b.ring, hash, func(point ringPoint, target uint64) int {
+		return cmp.Compare(point.hash, target)
+	})
+
+	seen := make(map[*BackendImpl]struct{})
+	for i := 0; i < len(b.ring) && len(seen) < len(b.members); i++ {
+		backend := b.ring[(start+i)%len(b.ring)].backend
+		if _, checked := seen[backend]; checked {
+			continue
+		}
+		seen[backend] = struct{}{}
+		if _, used := tried[backend]; used {
+			continue
+		}
+		if backend.index != -1 && b.hasCapacity(backend) {
+			return backend
+		}
+	}
+	return nil
+}
+
+// pick выбирает бэкенд для запроса. Вызывать под мьютексом.
+func (b *Balancer) pick(tried map[*BackendImpl]struct{}) *BackendImpl {
+	if b.cfg.PeakEWMA {
+		return b.pickByScore(tried)
+	}
+
+	root := b.backends[0]
+	if _, used := tried[root]; !used && b.hasCapacity(root) {
+		return root
+	}
+
+	// корень кучи занят или уже пробовали - редкий случай, поэтому здесь достаточно линейного поиска
+	var fresh, used *BackendImpl
+	for _, candidate := range b.backends {
+		if !b.hasCapacity(candidate) {
+			continue
+		}
+		if _, wasTried := tried[candidate]; wasTried {
+			if used == nil || lessLoaded(candidate, used) {
+				used = candidate
 			}
-			return resp, err
-		default:
-			time.Sleep(seconds)
-			seconds++
-			resp, err = backend.Invoke(ctx, req)
-			counter++
+			continue
+		}
+		if fresh == nil || lessLoaded(candidate, fresh) {
+			fresh = candidate
 		}
 	}
+	if fresh != nil {
+		return fresh
+	}
+	return used
+}
 
-	if err != nil {
-		checkReq := healthCheckRequest{}
-		b.wg.Add(1)
-		b.mu.Lock()
-		delete(b.backends, backend)
-		b.mu.Unlock()
-		go backend.HealthCheck(ctx, checkReq, b.stopChannel, b.syncChannel, b.wg)
+// pickByScore выбирает бэкенд с минимальным score среди тех, на которые еще не ходили в этом вызове.
+// Score меняется со временем из-за затухания, поэтому куча здесь не помогает, и используется линейный поиск.
+// Вызывать под мьютексом.
+func (b *Balancer) pickByScore(tried map[*BackendImpl]struct{}) *BackendImpl {
+	now := time.Now()
+	var fresh, used *BackendImpl
+	var freshScore, usedScore float64
+	for _, candidate := range b.backends {
+		if !b.hasCapacity(candidate) {
+			continue
+		}
+		score := b.score(candidate, now)
+		if _, wasTried := tried[candidate]; wasTried {
+			if used == nil || score < usedScore || (score == usedScore && candidate.pickedAt < used.pickedAt) {
+				used, usedScore = candidate, score
+			}
+			continue
+		}
+		if fresh == nil || score < freshScore || (score == freshScore && candidate.pickedAt < fresh.pickedAt) {
+			fresh, freshScore = candidate, score
+		}
+	}
+	if fresh != nil {
+		return fresh
+	}
+	return used
+}
+
+// peakEWMAPenalty - score бэкенда, про latency которого еще ничего не известно, но запросы уже в работе.
+// Так новый бэкенд получает запросы по одному, пока не ответит первый, а не весь трафик сразу.
+const peakEWMAPenalty = float64(time.Minute)
+
+// decayWeight - во сколько раз затухла peak-EWMA latency бэкенда с последнего обновления. Вызывать под мьютексом.
+func (b *Balancer) decayWeight(backend *BackendImpl, now time.Time) float64 {
+	elapsed := max(now.Sub(backend.costAt), 0)
+	return math.Exp(-float64(elapsed) / float64(b.cfg.DecayTime))
+}
+
+// score - ожидаемая задержка нового запроса на бэкенде. Вызывать под мьютексом.
+func (b *Balancer) score(backend *BackendImpl, now time.Time) float64 {
+	cost := backend.cost * b.decayWeight(backend, now)
+	if cost == 0 && backend.amountOfReq > 0 {
+		return peakEWMAPenalty + float64(backend.amountOfReq)
+	}
+	return cost * float64(backend.amountOfReq+1)
+}
+
+// observeLatency обновляет peak-EWMA latency бэкенда по завершенному запросу. Быстрая ошибка не должна делать
+// бэкенд привлекательнее, поэтому неудачный запрос удваивает latency. Вызывать под мьютексом.
+func (b *Balancer) observeLatency(backend *BackendImpl, latency time.Duration, failed bool) {
+	now := time.Now()
+	weight := b.decayWeight(backend, now)
+	cost := backend.cost * weight
+	rtt := float64(latency)
+	switch {
+	case failed:
+		backend.cost = max(2*cost, rtt)
+	case rtt > cost:
+		backend.cost = rtt
+	default:
+		backend.cost = cost + rtt*(1-weight)
+	}
+	backend.costAt = now
+}
+
+// limit возвращает действующий лимит запросов в работе, 0 - без лимита. Вызывать под мьютексом.
+func (b *Balancer) limit(backend *BackendImpl) int {
+	limit := b.cfg.MaxInFlight
+	if b.cfg.AdaptiveLimit && (limit == 0 || int(backend.limit) < limit) {
+		limit = int(backend.limit)
+	}
+	return limit
+}
+
+// hasCapacity проверяет, не исчерпан ли у бэкенда лимит запросов в работе. Вызывать под мьютексом.
+func (b *Balancer) hasCapacity(backend *BackendImpl) bool {
+	limit := b.limit(backend)
+	return limit == 0 || backend.amountOfReq < limit
+}
+
+// wakeWaiter будит первый вызов в очереди ожидания. Вызывать под мьютексом.
+func (b *Balancer) wakeWaiter() {
+	if len(b.waiters) == 0 {
+		return
+	}
+	close(b.waiters[0])
+	b.waiters = b.waiters[1:]
+}
+
+// cancelWait убирает вызов из очереди. Если его уже разбудили, сигнал передается следующему в очереди.
+func (b *Balancer) cancelWait(waiter chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx := slices.Index(b.waiters, waiter)
+	if idx == -1 {
+		b.wakeWaiter()
+		return
+	}
+	b.waiters = slices.Delete(b.waiters, idx, idx+1)
+}
+
+// adjustLimit пересчитывает адаптивный лимит бэкенда по результату запроса. Вызывать под мьютексом.
+func (b *Balancer) adjustLimit(backend *BackendImpl, latency time.Duration, failed bool) {
+	if !failed {
+		// latency без нагрузки медленно подтягивается вверх, чтобы лимит не схлопнулся,
+		// если бэкенд стал стабильно отвечать медленнее
+		if backend.minLatency == 0 || latency < backend.minLatency {
+			backend.minLatency = latency
+		} else {
+			backend.minLatency += (latency - backend.minLatency) / 100
+		}
+	}
+
+	overloaded := float64(latency) > b.cfg.LatencyTolerance*float64(backend.minLatency)
+	if failed || overloaded {
+		backend.limit = max(float64(b.cfg.MinLimit), backend.limit*0.9)
+		return
+	}
+	backend.limit = min(float64(b.cfg.MaxLimit), backend.limit+1/backend.limit)
+}
+
+// release учитывает завершение запроса и его результат (пассивный health-check по живому трафику):
+// после MaxFails ошибок подряд бэкенд исключается из балансировки, пока не пройдет активные проверки.
+// Запрос, который не дошел до бэкенда (RequestError), ничего не говорит о бэкенде и только освобождает емкость.
+func (b *Balancer) release(backend *BackendImpl, latency time.Duration, err error, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var reqErr *RequestError
+	sent := !errors.As(err, &reqErr)
+	if b.cfg.AdaptiveLimit && sent {
+		b.adjustLimit(backend, latency, failed)
+	}
+	if b.cfg.PeakEWMA && sent {
+		b.observeLatency(backend, latency, failed)
+	}
+	b.wakeWaiter()
+
+	backend.amountOfReq--
+	if backend.index != -1 {
+		heap.Fix(&b.backends, backend.index)
+	}
+	if backend.amountOfReq == 0 && backend.drained != nil {
+		close(backend.drained)
+		backend.drained = nil
+	}
+
+	if !sent {
+		return
+	}
+	if !failed {
+		backend.failures = 0
+		return
+	}
+	backend.failures++
+	backend.lastErr = err
+	backend.lastErrAt = time.Now()
+	if backend.active && backend.failures >= b.cfg.MaxFails {
+		b.deactivate(backend)
+	}
+}
+
+// Invoke отправляет запрос наименее загруженному бэкенду. При ошибке, которую имеет смысл повторить,
+// следующая попытка уходит на другой бэкенд после экспоненциального backoff-а с jitter-ом.
+// Backoff не выходит за дедлайн контекста: если до дедлайна попытка не успеет, Invoke сразу возвращает ошибку.
+func (b *Balancer) Invoke(ctx context.Context, req Request) (Response, error) {
+
+	invokeErr := &InvokeError{}
+	tried := make(map[*BackendImpl]struct{}, b.cfg.MaxAttempts)
+	key, _ := b.cfg.HashKey(ctx, req)
+
+	for attempt := 0; attempt < b.cfg.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := b.backoff(ctx, attempt); err != nil {
+				invokeErr.Attempts = append(invokeErr.Attempts, AttemptError{Err: err})
+				break
+			}
+		}
+
+		backend, err := b.acquire(ctx, key, tried)
+		if err != nil {
+			invokeErr.Attempts = append(invokeErr.Attempts, AttemptError{Err: err})
+			break
+		}
+		tried[backend] = struct{}{}
+
+		start := time.Now()
+		resp, err := backend.Invoke(ctx, req)
+		// отмена запроса вызывающим и ошибки клиента не говорят о том, что бэкенд сбоит
+		var reqErr *RequestError
+		failed := err != nil && ctx.Err() == nil && !errors.As(err, &reqErr) && b.cfg.IsRetryable(err)
+		b.release(backend, time.Since(start), err, failed)
+		if err == nil {
+			return resp, nil
+		}
+
+		invokeErr.Attempts = append(invokeErr.Attempts, AttemptError{Addr: backend.addr, Err: err})
+		if !failed {
+			break
+		}
+	}
+
+	return nil, invokeErr
+}
+
+// backoff ждет перед попыткой attempt: случайная задержка от 0 до BaseBackoff * 2^(attempt-1), но не больше MaxBackoff.
+func (b *Balancer) backoff(ctx context.Context, attempt int) error {
+	ceiling := b.cfg.BaseBackoff
+	for i := 1; i < attempt && ceiling < b.cfg.MaxBackoff; i++ {
+		ceiling *= 2
+	}
+	ceiling = min(ceiling, b.cfg.MaxBackoff)
+	delay := rand.N(ceiling + 1)
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+		return fmt.Errorf("Retry backoff exceeds context deadline: %w", context.DeadlineExceeded)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return resp, err
 }
 
 func (b *Balancer) Stop() {
-	close(b.stopChannel)
+	b.cancel()
 	b.wg.Wait()
-	close(b.syncChannel)
 }
@@ -0,0 +1,751 @@
+package main
+
+// Тесты запускаются вместе с файлом балансировщика:
+//
+//	go test iter2/loadBalancer.go iter2/loadBalancer_test.go
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newFakeBalancer(t testing.TB, transport *FakeTransport, addrs []string, cfg BalancerConfig) *Balancer {
+	t.Helper()
+	cfg.Transport = transport
+	balancer := NewBalancerWithConfig(addrs, cfg)
+	t.Cleanup(balancer.Stop)
+	return balancer
+}
+
+func TestInvokeSpreadsEvenlyOverIdleBackends(t *testing.T) {
+	addrs := []string{"a", "b", "c", "d"}
+	transport := NewFakeTransport()
+	balancer := newFakeBalancer(t, transport, addrs, BalancerConfig{})
+
+	for i := 0; i < 100; i++ {
+		if _, err := balancer.Invoke(context.Background(), "ping"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, addr := range addrs {
+		if calls := transport.Calls(addr); calls != 25 {
+			t.Fatalf("want 25 calls to each backend, %s got %d", addr, calls)
+		}
+	}
+}
+
+func BenchmarkInvoke(b *testing.B) {
+	for _, backends := range []int{4, 64} {
+		b.Run(fmt.Sprintf("backends=%d", backends), func(b *testing.B) {
+			addrs := make([]string, 0, backends)
+			for i := 0; i < backends; i++ {
+				addrs = append(addrs, fmt.Sprintf("backend-%d", i))
+			}
+			transport := NewFakeTransport()
+			balancer := newFakeBalancer(b, transport, addrs, BalancerConfig{})
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := balancer.Invoke(context.Background(), "ping"); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+
+			// разброс количества запросов между бэкендами относительно среднего
+			least, most := b.N, 0
+			for _, addr := range addrs {
+				calls := transport.Calls(addr)
+				least, most = min(least, calls), max(most, calls)
+			}
+			b.ReportMetric(float64(most-least)/(float64(b.N)/float64(backends)), "spread")
+		})
+	}
+}
+
+func TestRetryResendsHTTPRequestBody(t *testing.T) {
+	var mu sync.Mutex
+	bodies := make(map[string]string)
+	handler := func(status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/items" {
+				w.WriteHeader(status)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			bodies[r.Host] = string(body)
+			mu.Unlock()
+			w.WriteHeader(status)
+		}
+	}
+	failing := httptest.NewServer(handler(http.StatusServiceUnavailable))
+	defer failing.Close()
+	healthy := httptest.NewServer(handler(http.StatusOK))
+	defer healthy.Close()
+	failingAddr := strings.TrimPrefix(failing.URL, "http://")
+	healthyAddr := strings.TrimPrefix(healthy.URL, "http://")
+
+	for name, newBody := range map[string]func() io.Reader{
+		"with GetBody":    func() io.Reader { return strings.NewReader("payload") },
+		"without GetBody": func() io.Reader { return io.MultiReader(strings.NewReader("pay"), strings.NewReader("load")) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			// одинаково загруженные бэкенды выбираются по кругу, первым - первый в списке
+			balancer := NewBalancerWithConfig([]string{failingAddr, healthyAddr}, BalancerConfig{BaseBackoff: time.Millisecond})
+			defer balancer.Stop()
+
+			req, err := http.NewRequest(http.MethodPost, "http://service/items", newBody())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := balancer.Invoke(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if bodies[failingAddr] != "payload" || bodies[healthyAddr] != "payload" {
+				t.Fatalf("want full body on every attempt, got %q", bodies)
+			}
+		})
+	}
+}
+
+func TestRequestErrorIsNotRetriedNorChargedToBackend(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			calls.Add(1)
+		}
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	balancer := NewBalancerWithConfig([]string{addr}, BalancerConfig{MaxFails: 1, BaseBackoff: time.Millisecond})
+	defer balancer.Stop()
+
+	// канал не кодируется в JSON
+	_, err := balancer.Invoke(context.Background(), make(chan int))
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) {
+		t.Fatalf("want RequestError, got %v", err)
+	}
+	var invokeErr *InvokeError
+	if !errors.As(err, &invokeErr) || len(invokeErr.Attempts) != 1 {
+		t.Fatalf("want a single attempt, got %v", err)
+	}
+
+	status := balancer.Backends()[0]
+	if status.State != BackendHealthy || status.Failures != 0 {
+		t.Fatalf("want backend untouched by client error, got %+v", status)
+	}
+	if _, err := balancer.Invoke(context.Background(), map[string]string{"ok": "yes"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("want one request to reach the backend, got %d", calls.Load())
+	}
+}
+
+func TestPeakEWMAAvoidsSlowBackendUntilItRecovers(t *testing.T) {
+	transport := NewFakeTransport()
+	transport.Script("fast", FakeStep{Latency: time.Millisecond})
+	transport.Script("slow", FakeStep{Latency: 20 * time.Millisecond})
+	balancer := newFakeBalancer(t, transport, []string{"fast", "slow"}, BalancerConfig{
+		PeakEWMA:  true,
+		DecayTime: 200 * time.Millisecond,
+	})
+
+	for i := 0; i < 200; i++ {
+		if _, err := balancer.Invoke(context.Background(), "ping"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// медленный бэкенд получает только редкие пробные запросы, когда его latency затухает
+	if calls := transport.Calls("slow"); calls > 10 {
+		t.Fatalf("want slow backend to get almost no traffic, got %d of 200", calls)
+	}
+
+	// бэкенд восстановился: без трафика его latency затухает, и он снова получает запросы
+	transport.Script("slow", FakeStep{Latency: time.Millisecond})
+	time.Sleep(5 * 200 * time.Millisecond)
+	before := transport.Calls("slow")
+	for i := 0; i < 100; i++ {
+		if _, err := balancer.Invoke(context.Background(), "ping"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := transport.Calls("slow") - before; calls < 5 {
+		t.Fatalf("want recovered backend back in rotation, got %d of 100", calls)
+	}
+}
+
+func TestPeakEWMAPrefersFastBackendUnderConcurrency(t *testing.T) {
+	transport := NewFakeTransport()
+	transport.Script("fast", FakeStep{Latency: time.Millisecond})
+	transport.Script("mid", FakeStep{Latency: 5 * time.Millisecond})
+	transport.Script("slow", FakeStep{Latency: 20 * time.Millisecond})
+	balancer := newFakeBalancer(t, transport, []string{"fast", "mid", "slow"}, BalancerConfig{PeakEWMA: true})
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 75; i++ {
+				if _, err := balancer.Invoke(context.Background(), "ping"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	fast, mid, slow := transport.Calls("fast"), transport.Calls("mid"), transport.Calls("slow")
+	if fast < 240 || slow > mid+5 {
+		t.Fatalf("want most traffic on the fast backend, got fast=%d mid=%d slow=%d", fast, mid, slow)
+	}
+}
+
+// backendStates возвращает состояние каждого бэкенда балансировщика по адресу.
+func backendStates(balancer *Balancer) map[string]BackendState {
+	states := make(map[string]BackendState)
+	for _, status := range balancer.Backends() {
+		states[status.Addr] = status.State
+	}
+	return states
+}
+
+// waitFor ждет, пока cond не станет true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// invokeAsync запускает Invoke в фоне и ждет, пока запрос не окажется в работе у addr.
+func invokeAsync(t *testing.T, balancer *Balancer, addr string) chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		_, err := balancer.Invoke(context.Background(), "ping")
+		done <- err
+	}()
+	waitFor(t, "request in flight on "+addr, func() bool {
+		for _, status := range balancer.Backends() {
+			if status.Addr == addr && status.InFlight > 0 {
+				return true
+			}
+		}
+		return false
+	})
+	return done
+}
+
+func TestAddAndRemoveBackend(t *testing.T) {
+	transport := NewFakeTransport()
+	balancer := newFakeBalancer(t, transport, []string{"a"}, BalancerConfig{})
+
+	if err := balancer.AddBackend("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := balancer.AddBackend("b"); err == nil {
+		t.Fatal("want error for a duplicate backend")
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := balancer.Invoke(context.Background(), "ping"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if transport.Calls("a") != 5 || transport.Calls("b") != 5 {
+		t.Fatalf("want added backend in rotation, got a=%d b=%d", transport.Calls("a"), transport.Calls("b"))
+	}
+
+	if err := balancer.RemoveBackend(context.Background(), "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := balancer.RemoveBackend(context.Background(), "b"); err == nil {
+		t.Fatal("want error for a removed backend")
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := balancer.Invoke(context.Background(), "ping"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if states := backendStates(balancer); len(states) != 1 || transport.Calls("b") != 5 {
+		t.Fatalf("want removed backend to get no traffic, got %v and %d calls", states, transport.Calls("b"))
+	}
+}
+
+func TestRemoveBackendDrainsRequestsInFlight(t *testing.T) {
+	transport := NewFakeTransport()
+	transport.Script("b", FakeStep{Latency: 300 * time.Millisecond})
+	balancer := newFakeBalancer(t, transport, []string{"b", "a"}, BalancerConfig{})
+	inFlight := invokeAsync(t, balancer, "b")
+
+	removed := make(chan error, 1)
+	go func() { removed <- balancer.RemoveBackend(context.Background(), "b") }()
+	waitFor(t, "b to start draining", func() bool { return backendStates(balancer)["b"] == BackendDraining })
+
+	// новые запросы на удаляемый бэкенд не идут
+	for i := 0; i < 5; i++ {
+		if _, err := balancer.Invoke(context.Background(), "ping"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := transport.Calls("b"); calls != 1 {
+		t.Fatalf("want no new requests to a draining backend, got %d", calls)
+	}
+
+	if err := <-inFlight; err != nil {
+		t.Fatalf("want request in flight to complete, got %v", err)
+	}
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+	if _, found := backendStates(balancer)["b"]; found {
+		t.Fatal("want drained backend to be removed")
+	}
+}
+
+func TestRemoveBackendGivesUpAfterContext(t *testing.T) {
+	transport := NewFakeTransport()
+	transport.Script("b", FakeStep{Latency: time.Second})
+	balancer := newFakeBalancer(t, transport, []string{"b", "a"}, BalancerConfig{})
+	invokeAsync(t, balancer, "b")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := balancer.RemoveBackend(ctx, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded, got %v", err)
+	}
+	if _, found := backendStates(balancer)["b"]; found {
+		t.Fatal("want backend removed after the drain timeout")
+	}
+}
+
+func TestAddBackendCancelsDrain(t *testing.T) {
+	transport := NewFakeTransport()
+	transport.Script("b", FakeStep{Latency: 300 * time.Millisecond})
+	balancer := newFakeBalancer(t, transport, []string{"b", "a"}, BalancerConfig{})
+	inFlight := invokeAsync(t, balancer, "b")
+
+	removed := make(chan error, 1)
+	go func() { removed <- balancer.RemoveBackend(context.Background(), "b") }()
+	waitFor(t, "b to start draining", func() bool { return backendStates(balancer)["b"] == BackendDraining })
+
+	if err := balancer.AddBackend("b"); err != nil {
+		t.Fatalf("want draining backend to be added back, got %v", err)
+	}
+	if err := <-removed; err == nil {
+		t.Fatal("want RemoveBackend to report that the backend was added back")
+	}
+	if state, found := backendStates(balancer)["b"]; !found || state != BackendHealthy {
+		t.Fatalf("want b healthy again, got %v", backendStates(balancer))
+	}
+	if err := <-inFlight; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetBackends(t *testing.T) {
+	transport := NewFakeTransport()
+	balancer := newFakeBalancer(t, transport, []string{"a", "b"}, BalancerConfig{})
+
+	if err := balancer.SetBackends(context.Background(), []string{"b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	states := backendStates(balancer)
+	if _, found := states["a"]; found || len(states) != 2 || states["b"] != BackendHealthy || states["c"] != BackendHealthy {
+		t.Fatalf("want backends b and c, got %v", states)
+	}
+}
+
+func TestWatchBackendsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a\n# запасной\nb\n\nb\n")
+
+	transport := NewFakeTransport()
+	balancer := newFakeBalancer(t, transport, nil, BalancerConfig{})
+	// interval <= 0 не должен ронять watcher
+	if err := balancer.WatchBackendsFile(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if states := backendStates(balancer); len(states) != 2 || states["a"] != BackendHealthy || states["b"] != BackendHealthy {
+		t.Fatalf("want backends a and b from the file, got %v", states)
+	}
+
+	balancer = newFakeBalancer(t, transport, nil, BalancerConfig{})
+	if err := balancer.WatchBackendsFile(path, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	write("b\nc\n")
+	waitFor(t, "backends from the new file", func() bool {
+		states := backendStates(balancer)
+		_, hasA := states["a"]
+		return len(states) == 2 && !hasA && states["c"] == BackendHealthy
+	})
+
+	// пустой файл игнорируется
+	write("# пусто\n")
+	time.Sleep(50 * time.Millisecond)
+	if states := backendStates(balancer); len(states) != 2 {
+		t.Fatalf("want empty file to be ignored, got %v", states)
+	}
+
+	if err := balancer.WatchBackendsFile(filepath.Join(t.TempDir(), "missing"), time.Second); err == nil {
+		t.Fatal("want error for a missing file")
+	}
+}
+
+// backendLimit возвращает текущий адаптивный лимит бэкенда.
+func backendLimit(balancer *Balancer, addr string) float64 {
+	balancer.mu.Lock()
+	defer balancer.mu.Unlock()
+	return balancer.member(addr).limit
+}
+
+func TestAdaptiveLimitAIMD(t *testing.T) {
+	transport := NewFakeTransport()
+	transport.Script("a", FakeStep{Latency: time.Millisecond})
+	balancer := newFakeBalancer(t, transport, []string{"a"}, BalancerConfig{
+		AdaptiveLimit:    true,
+		InitialLimit:     10,
+		LatencyTolerance: 50,
+		MaxAttempts:      1,
+	})
+	invoke := func() {
+		t.Helper()
+		balancer.Invoke(context.Background(), "ping")
+	}
+	near := func(a, b float64) bool { return a-b < 1e-9 && b-a < 1e-9 }
+
+	// быстрые успешные запросы: лимит растет на 1/limit
+	for i := 0; i < 10; i++ {
+		before := backendLimit(balancer, "a")
+		invoke()
+		if after := backendLimit(balancer, "a"); !near(after, before+1/before) {
+			t.Fatalf("want additive increase from %v, got %v", before, after)
+		}
+	}
+
+	// ошибка: лимит умножается на 0.9
+	transport.Script("a", FakeStep{Err: errors.New("boom")})
+	before := backendLimit(balancer, "a")
+	invoke()
+	if after := backendLimit(balancer, "a"); !near(after, before*0.9) {
+		t.Fatalf("want multiplicative decrease after error from %v, got %v", before, after)
+	}
+
+	// успешный, но слишком медленный запрос - признак перегрузки
+	transport.Script("a", FakeStep{Latency: 200 * time.Millisecond})
+	before = backendLimit(balancer, "a")
+	invoke()
+	if after := backendLimit(balancer, "a"); !near(after, before*0.9) {
+		t.Fatalf("want multiplicative decrease after slow request from %v, got %v", before, after)
+	}
+}
+
+func TestMaxInFlightQueuesCallersInOrder(t *testing.T) {
+	transport := NewFakeTransport()
+	transport.Script("a", FakeStep{Latency: 20 * time.Millisecond})
+	balancer := newFakeBalancer(t, transport, []string{"a"}, BalancerConfig{MaxInFlight: 1, QueueSize: 3, MaxAttempts: 1})
+	queued := func() int {
+		balancer.mu.Lock()
+		defer balancer.mu.Unlock()
+		return len(balancer.waiters)
+	}
+
+	first := invokeAsync(t, balancer, "a")
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			if _, err := balancer.Invoke(context.Background(), "ping"); err != nil {
+				t.Error(err)
+			}
+			order <- i
+		}()
+		waitFor(t, "caller to queue", func() bool { return queued() == i+1 })
+	}
+
+	// очередь заполнена
+	if _, err := balancer.Invoke(context.Background(), "ping"); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("want ErrOverloaded with full queue, got %v", err)
+	}
+
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	// бэкенд обрабатывает по одному запросу, поэтому порядок завершения - порядок выхода из очереди
+	for want := 0; want < 3; want++ {
+		if got := <-order; got != want {
+			t.Fatalf("want queued caller %d to go next, got %d", want, got)
+		}
+	}
+}
+
+func TestQueuedCallerGetsErrOverloadedOnDeadline(t *testing.T) {
+	transport := NewFakeTransport()
+	transport.Script("a", FakeStep{Latency: 300 * time.Millisecond})
+	balancer := newFakeBalancer(t, transport, []string{"a"}, BalancerConfig{MaxInFlight: 1, QueueSize: 1, MaxAttempts: 1})
+	invokeAsync(t, balancer, "a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := balancer.Invoke(ctx, "ping")
+	if !errors.Is(err, ErrOverloaded) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want ErrOverloaded caused by the deadline, got %v", err)
+	}
+
+	// без очереди вызов сразу получает ErrOverloaded
+	balancer = newFakeBalancer(t, transport, []string{"a"}, BalancerConfig{MaxInFlight: 1, MaxAttempts: 1})
+	invokeAsync(t, balancer, "a")
+	if _, err := balancer.Invoke(context.Background(), "ping"); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("want ErrOverloaded without queue, got %v", err)
+	}
+}
+
+// ringOwners возвращает бэкенд, который consistent hashing выбирает для каждого ключа.
+func ringOwners(balancer *Balancer, keys []string) map[string]string {
+	balancer.mu.Lock()
+	defer balancer.mu.Unlock()
+	owners := make(map[string]string, len(keys))
+	for _, key := range keys {
+		owners[key] = balancer.pickByHash(key, nil).addr
+	}
+	return owners
+}
+
+func TestHashKeySticksToBackend(t *testing.T) {
+	transport := NewFakeTransport()
+	addrs := []string{"a", "b", "c", "d"}
+	balancer := newFakeBalancer(t, transport, addrs, BalancerConfig{})
+
+	ctx := WithHashKey(context.Background(), "user-42")
+	for i := 0; i < 20; i++ {
+		if _, err := balancer.Invoke(ctx, "ping"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	owners := 0
+	for _, addr := range addrs {
+		switch transport.Calls(addr) {
+		case 0:
+		case 20:
+			owners++
+		default:
+			t.Fatalf("want all requests with one key on one backend, %s got %d", addr, transport.Calls(addr))
+		}
+	}
+	if owners != 1 {
+		t.Fatalf("want exactly one owner, got %d", owners)
+	}
+}
+
+func TestRingMovesOnlyShareOfKeys(t *testing.T) {
+	balancer := newFakeBalancer(t, NewFakeTransport(), []string{"a", "b", "c", "d"}, BalancerConfig{})
+	keys := make([]string, 2000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user-%d", i)
+	}
+	before := ringOwners(balancer, keys)
+
+	// новый бэкенд забирает около 1/5 ключей, и только себе
+	if err := balancer.AddBackend("e"); err != nil {
+		t.Fatal(err)
+	}
+	added := ringOwners(balancer, keys)
+	moved := 0
+	for _, key := range keys {
+		if added[key] != before[key] {
+			moved++
+			if added[key] != "e" {
+				t.Fatalf("key %s moved from %s to %s, not to the new backend", key, before[key], added[key])
+			}
+		}
+	}
+	if share := float64(moved) / float64(len(keys)); share < 0.1 || share > 0.3 {
+		t.Fatalf("want about 1/5 of keys to move, got %.2f", share)
+	}
+
+	// после удаления ключи возвращаются к прежним владельцам
+	if err := balancer.RemoveBackend(context.Background(), "e"); err != nil {
+		t.Fatal(err)
+	}
+	for key, owner := range ringOwners(balancer, keys) {
+		if owner != before[key] {
+			t.Fatalf("key %s owned by %s after removal, want %s", key, owner, before[key])
+		}
+	}
+
+	// удаление бэкенда переносит только его ключи
+	if err := balancer.RemoveBackend(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	for key, owner := range ringOwners(balancer, keys) {
+		if before[key] != "a" && owner != before[key] {
+			t.Fatalf("key %s of %s moved to %s after removing a", key, before[key], owner)
+		}
+	}
+}
+
+func TestHashKeyFallsBackToNextNodeWhenOwnerUnhealthy(t *testing.T) {
+	transport := NewFakeTransport()
+	balancer := newFakeBalancer(t, transport, []string{"a", "b", "c", "d"}, BalancerConfig{MaxFails: 1, BaseBackoff: time.Millisecond})
+	const key = "user-7"
+	owner := ringOwners(balancer, []string{key})[key]
+	balancer.mu.Lock()
+	next := balancer.pickByHash(key, map[*BackendImpl]struct{}{balancer.member(owner): {}}).addr
+	balancer.mu.Unlock()
+
+	// владелец ключа отвечает ошибкой и исключается: попытка уходит на следующий по кольцу бэкенд
+	transport.Script(owner, FakeStep{Err: errors.New("down")})
+	ctx := WithHashKey(context.Background(), key)
+	if _, err := balancer.Invoke(ctx, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if backendStates(balancer)[owner] != BackendUnhealthy {
+		t.Fatalf("want owner %s unhealthy, got %v", owner, backendStates(balancer))
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := balancer.Invoke(ctx, "ping"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := transport.Calls(next); calls != 11 {
+		t.Fatalf("want every request on the next node %s, got %d of 11", next, calls)
+	}
+}
+
+// manualHealthTransport отвечает на живые запросы сразу, а результат каждого health-check-а задает тест.
+type manualHealthTransport struct {
+	checks  chan struct{} // сигнал о начале очередной проверки
+	results chan error
+}
+
+func (t *manualHealthTransport) Send(ctx context.Context, addr string, req Request) (Response, error) {
+	if _, ok := req.(healthCheckRequest); !ok {
+		return "pong", nil
+	}
+	select {
+	case t.checks <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case err := <-t.results:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	transport := &manualHealthTransport{checks: make(chan struct{}), results: make(chan error)}
+	balancer := NewBalancerWithConfig([]string{"a"}, BalancerConfig{
+		Transport:           transport,
+		HealthCheckInterval: 5 * time.Millisecond,
+		HealthCheckTimeout:  5 * time.Second,
+		HealthyThreshold:    2,
+		UnhealthyThreshold:  3,
+	})
+	defer balancer.Stop()
+
+	// check завершает текущую проверку с результатом err и ждет начала следующей:
+	// к этому моменту результат уже учтен
+	<-transport.checks
+	down := errors.New("down")
+	check := func(err error, want BackendState) {
+		t.Helper()
+		transport.results <- err
+		<-transport.checks
+		if status := balancer.Backends()[0]; status.State != want {
+			t.Fatalf("want %v after check with %v, got %+v", want, err, status)
+		}
+	}
+
+	check(down, BackendHealthy)
+	check(down, BackendHealthy)
+	// успешная проверка сбрасывает счетчик неудач
+	check(nil, BackendHealthy)
+	check(down, BackendHealthy)
+	check(down, BackendHealthy)
+	check(down, BackendUnhealthy)
+	if status := balancer.Backends()[0]; !errors.Is(status.LastErr, down) || status.LastCheckAt.IsZero() {
+		t.Fatalf("want last health check error in status, got %+v", status)
+	}
+	if _, err := balancer.Invoke(context.Background(), "ping"); err == nil {
+		t.Fatal("want no traffic to an unhealthy backend")
+	}
+
+	check(nil, BackendUnhealthy)
+	check(down, BackendUnhealthy)
+	check(nil, BackendUnhealthy)
+	check(nil, BackendHealthy)
+	if _, err := balancer.Invoke(context.Background(), "ping"); err != nil {
+		t.Fatalf("want recovered backend back in rotation, got %v", err)
+	}
+}
+
+func TestHealthPathIsConfigurable(t *testing.T) {
+	var mu sync.Mutex
+	paths := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path != "/ready" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+	checked := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return paths[path]
+	}
+
+	cfg := BalancerConfig{HealthCheckInterval: 5 * time.Millisecond, UnhealthyThreshold: 1}
+	// по умолчанию проверяется /health, и бэкенд без него исключается
+	byDefault := NewBalancerWithConfig([]string{addr}, cfg)
+	defer byDefault.Stop()
+	waitFor(t, "backend without /health to become unhealthy", func() bool {
+		return backendStates(byDefault)[addr] == BackendUnhealthy
+	})
+
+	cfg.HealthPath = "/ready"
+	custom := NewBalancerWithConfig([]string{addr}, cfg)
+	defer custom.Stop()
+	start := checked("/ready")
+	waitFor(t, "checks of /ready", func() bool { return checked("/ready") >= start+3 })
+	if state := backendStates(custom)[addr]; state != BackendHealthy {
+		t.Fatalf("want backend healthy with custom health path, got %v", state)
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"errors"
 	"net"
+	"slices"
 	"sync"
 	"time"
 
 	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/resolver"
 )
 
@@ -38,19 +40,36 @@ const (
 	Closed
 )
 
+// через сколько нода с разомкнутым circuit breaker-ом снова отправляется на health-check
+const openCircuitTimeout = 10 * time.Second
+
 type BalancerConfig struct {
 	HealthCheckInterval time.Duration
 	HealthCheckTimeout  time.Duration
 	MaxFails            int
+	// зона, в которой запущен клиент. Пустая строка - балансировка без учета зон
+	LocalZone string
+	// минимальная доля (в процентах) здоровой емкости локальной зоны, при которой трафик не уходит в другие зоны
+	MinLocalHealthyPercent int
+	// исключение нод, которые работают статистически хуже соседей
+	Outlier OutlierConfig
+	// размер подмножества бэкендов, к которым подключается клиент. 0 - подключаться ко всем
+	SubsetSize int
+	// порядковый номер клиента, по нему выбирается подмножество
+	ClientID uint64
 }
 
 type Node struct {
 	state          nodeState
 	address        string
-	amountOfErrors int         // количество ошибок
-	rate           int         // количество запросов
-	maxRates       int         // максимальное количество запросов, которое можно отправить на хост - паттерн circuit breaker
-	timer          time.Ticker // тикер, который будет работать, когда circuit breaker будет в закрытом состоянии
+	amountOfErrors int          // количество ошибок
+	rate           int          // количество запросов
+	maxRates       int          // максимальное количество запросов, которое можно отправить на хост - паттерн circuit breaker
+	timer          *time.Ticker // тикер, который будет работать, когда circuit breaker будет в закрытом состоянии
+	weight         uint32       // атрибуты адреса, которые проставляет resolver
+	zone           string
+	version        string
+	ready          bool // SubConn в состоянии READY
 }
 
 type customBalancer struct {
@@ -63,34 +82,76 @@ type customBalancer struct {
 	mu       *sync.RWMutex
 	wg       *sync.WaitGroup
 	cc       balancer.ClientConn
+	metrics  *balancerMetrics // общие для builder-а и построенных им балансировщиков
+	id       uint64           // номер балансировщика в метриках
+	outlier  *outlierDetector
 }
 
 func NewBuilder(cfg BalancerConfig) balancer.Builder {
-	return customBalancer{cfg: cfg, name: "customGRPCBalancer"}
+	if cfg.HealthCheckInterval <= 0 {
+		cfg.HealthCheckInterval = time.Second
+	}
+	return &customBalancer{cfg: cfg, name: "customGRPCBalancer", metrics: newBalancerMetrics()}
 }
 
-func (b customBalancer) Name() string {
+func (b *customBalancer) Name() string {
 	return b.name
 }
 
-func (b customBalancer) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+func (b *customBalancer) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
 	stopChan := make(chan struct{})
 	var wg sync.WaitGroup
 	var mu sync.RWMutex
-	nodes := make([]Node, 0)
 	subConns := make(map[string]balancer.SubConn, 100)
+	id := b.metrics.register()
+
+	// состояние балансировщика должно быть общим для горутины health-check-ов, Pick и колбеков gRPC,
+	// поэтому дальше везде работаем через указатель
+	bal := &customBalancer{
+		name:     b.name,
+		cfg:      b.cfg,
+		nodes:    make([]Node, 0),
+		wg:       &wg,
+		mu:       &mu,
+		stopChan: stopChan,
+		next:     0,
+		cc:       cc,
+		subConns: subConns,
+		metrics:  b.metrics,
+		id:       id,
+		outlier:  newOutlierDetector(b.cfg.Outlier, b.metrics, id),
+	}
+
+	if bal.outlier.enabled() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(b.cfg.Outlier.Interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopChan:
+					return
+				case now := <-ticker.C:
+					bal.outlier.evaluate(now)
+				}
+			}
+		}()
+	}
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
+		ticker := time.NewTicker(b.cfg.HealthCheckInterval)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-stopChan:
 				return
-			default:
+			case <-ticker.C:
 				mu.RLock()
-				nodesCopy := make([]Node, 0, len(nodes))
-				for _, backend := range nodes {
+				nodesCopy := make([]Node, 0, len(bal.nodes))
+				for _, backend := range bal.nodes {
 					nodesCopy = append(nodesCopy, backend)
 				}
 				hcInt := b.cfg.HealthCheckInterval
@@ -98,24 +159,24 @@ func (b customBalancer) Build(cc balancer.ClientConn, opts balancer.BuildOptions
 				maxFails := b.cfg.MaxFails
 				mu.RUnlock()
 				for key := range nodesCopy {
-					mu.RLock()
-					nodeState := nodes[key].state
-					nodeAddress := nodes[key].address
-					mu.RUnlock()
-					if nodeState == Open {
+					nodeState := nodesCopy[key].state
+					nodeAddress := nodesCopy[key].address
+					if nodeState == Open && nodesCopy[key].timer != nil {
 						select {
-						case <-nodes[key].timer.C:
+						case <-nodesCopy[key].timer.C:
 							wg.Add(1)
 							go func() {
 								defer wg.Done()
-								hc := HealthCheckerEx{timeout: hcTime}
+								hc := HealthCheckerEx{timeout: hcTime, metrics: b.metrics, balancer: id}
 								timerInt := time.NewTicker(hcInt)
 								defer timerInt.Stop()
 								for {
 									select {
 									case <-stopChan:
 										mu.Lock()
-										nodes[key].timer.Stop()
+										if node := bal.nodeByAddress(nodeAddress); node != nil {
+											stopTimer(node)
+										}
 										mu.Unlock()
 										return
 									case <-timerInt.C:
@@ -123,38 +184,45 @@ func (b customBalancer) Build(cc balancer.ClientConn, opts balancer.BuildOptions
 										if err == nil {
 											mu.Lock()
 											defer mu.Unlock()
-											address := resolver.Address{Addr: nodes[key].address}
+											node := bal.nodeByAddress(nodeAddress)
+											if node == nil {
+												return
+											}
+											address := resolver.Address{Addr: node.address}
 											subConn, err := cc.NewSubConn([]resolver.Address{address}, balancer.NewSubConnOptions{})
 											if err != nil {
-												nodes[key].state = Open
-												nodes[key].timer.Reset(10 * time.Second)
+												bal.openCircuit(node)
 												return
 											}
-											subConns[nodes[key].address] = subConn
-											if nodes[key].rate/2 > nodes[key].amountOfErrors {
-												nodes[key].state = HalfOpen
-												nodes[key].maxRates = 20
+											subConns[node.address] = subConn
+											subConn.Connect()
+											if node.rate/2 > node.amountOfErrors {
+												bal.setState(node, HalfOpen)
+												node.maxRates = 20
 											} else {
-												nodes[key].state = Closed
-												nodes[key].maxRates = -1
+												bal.setState(node, Closed)
+												node.maxRates = -1
 											}
-											nodes[key].timer.Stop()
+											stopTimer(node)
 											return
 										}
 										if err != nil || !state {
 											maxFails--
-											b.mu.Lock()
-											nodes[key].amountOfErrors++
-											nodes[key].rate++
-											b.mu.Unlock()
+											mu.Lock()
+											node := bal.nodeByAddress(nodeAddress)
+											if node == nil {
+												mu.Unlock()
+												return
+											}
+											node.amountOfErrors++
+											node.rate++
 											if maxFails == 0 {
-												b.mu.Lock()
-												nodes[key].state = Open
-												nodes[key].timer.Reset(10 * time.Second)
-												delete(subConns, nodes[key].address)
-												b.mu.Unlock()
+												bal.openCircuit(node)
+												delete(subConns, node.address)
+												mu.Unlock()
 												return
 											}
+											mu.Unlock()
 										}
 										hcInt *= 2
 										timerInt.Reset(hcInt)
@@ -169,153 +237,272 @@ func (b customBalancer) Build(cc balancer.ClientConn, opts balancer.BuildOptions
 		}
 	}()
 
-	return customBalancer{
-		name:     b.name,
-		cfg:      b.cfg,
-		nodes:    nodes,
-		wg:       &wg,
-		mu:       &mu,
-		stopChan: stopChan,
-		next:     0,
-		cc:       cc,
-		subConns: subConns,
+	return bal
+}
+
+// setState переводит circuit breaker ноды в новое состояние и учитывает переход в метриках. Вызывать под мьютексом.
+func (b *customBalancer) setState(node *Node, state nodeState) {
+	node.state = state
+	b.metrics.recordState(b.id, node.address, state)
+}
+
+// openCircuit размыкает circuit breaker ноды и запускает таймер, по которому нода снова попадет на health-check.
+// Вызывать под мьютексом.
+func (b *customBalancer) openCircuit(node *Node) {
+	b.setState(node, Open)
+	if node.timer == nil {
+		node.timer = time.NewTicker(openCircuitTimeout)
+		return
 	}
+	node.timer.Reset(openCircuitTimeout)
 }
 
-func (b customBalancer) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+// stopTimer останавливает таймер повторного health-check-а ноды. Вызывать под мьютексом.
+func stopTimer(node *Node) {
+	if node.timer != nil {
+		node.timer.Stop()
+	}
+}
 
-	var backend Node
+// nodeByAddress возвращает ноду по адресу. Вызывать под мьютексом.
+func (b *customBalancer) nodeByAddress(address string) *Node {
+	for key := range b.nodes {
+		if b.nodes[key].address == address {
+			return &b.nodes[key]
+		}
+	}
+	return nil
+}
 
-	b.mu.RLock()
-	backends := make([]Node, 0, len(b.nodes))
-	for _, back := range b.nodes {
-		backends = append(backends, back)
+// available проверяет, можно ли отправить запрос на ноду: SubConn подключен, нода не исключена outlier detection-ом,
+// а circuit breaker закрыт или полуоткрыт и еще не исчерпал лимит пробных запросов. Вызывать под мьютексом.
+func (b *customBalancer) available(node Node) bool {
+	if _, exists := b.subConns[node.address]; !exists || !node.ready || b.outlier.isEjected(node.address) {
+		return false
 	}
-	nextNode := b.next
-	b.mu.RUnlock()
+	return node.state == Closed || (node.state == HalfOpen && node.maxRates > node.rate)
+}
 
-	finalNode := nextNode
-	for {
-		backend = backends[nextNode%len(backends)]
-		if backend.state == Closed || (backend.state == HalfOpen && backend.maxRates > backend.rate) {
-			b.mu.Lock()
-			b.next = nextNode + 1
-			subconn := b.subConns[backend.address]
-			b.nodes[nextNode%len(backends)].rate++
-			b.mu.Unlock()
-			return balancer.PickResult{SubConn: subconn}, nil
+// candidates возвращает индексы нод, между которыми делается round-robin.
+// Если задана зона клиента, предпочитаются ноды из нее. На другие зоны трафик уходит, только когда
+// доля здоровой емкости (с учетом весов) в локальной зоне падает ниже MinLocalHealthyPercent.
+// Вызывать под мьютексом.
+func (b *customBalancer) candidates() []int {
+	healthy := make([]int, 0, len(b.nodes))
+	local := make([]int, 0, len(b.nodes))
+	localWeight, localHealthyWeight := 0, 0
+
+	for key, node := range b.nodes {
+		isLocal := b.cfg.LocalZone != "" && node.zone == b.cfg.LocalZone
+		if isLocal {
+			localWeight += int(node.weight)
 		}
-		if nextNode == finalNode {
-			return balancer.PickResult{}, errors.New("No backends are available")
+		if !b.available(node) {
+			continue
 		}
-		nextNode++
+		healthy = append(healthy, key)
+		if isLocal {
+			local = append(local, key)
+			localHealthyWeight += int(node.weight)
+		}
+	}
+
+	if len(local) > 0 && localHealthyWeight*100 >= b.cfg.MinLocalHealthyPercent*localWeight {
+		return local
 	}
+	return healthy
 }
 
-func (b customBalancer) ExitIdle() {
+func (b *customBalancer) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	candidates := b.candidates()
+	if len(candidates) == 0 {
+		for _, node := range b.nodes {
+			// SubConn еще подключается - просим gRPC дождаться следующего picker-а
+			if _, exists := b.subConns[node.address]; exists && node.state != Open && !node.ready {
+				return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+			}
+		}
+		err := errors.New("No backends are available")
+		b.metrics.recordPick(b.id, info.FullMethodName, "", err)
+		return balancer.PickResult{}, err
+	}
 
-}
+	// hedge-попытки и retry одного RPC отправляем на разные ноды
+	var attempts *hedgeAttempts
+	if info.Ctx != nil {
+		attempts, _ = info.Ctx.Value(hedgeKey{}).(*hedgeAttempts)
+	}
+	candidates = b.excludeAttempted(candidates, attempts)
 
-// ResolverError вызывается gRPC, когда resolver сообщает об ошибке. Пример ошибки: проблема с резолвингом адресов.
-// При этом необходимо пройтись по всем адресам и позапускать health check-и, чтобы проверить, что бэкенды доступны и работают.
-func (b customBalancer) ResolverError(err error) {
+	key := candidates[b.next%len(candidates)]
+	b.next++
+	b.nodes[key].rate++
+
+	address := b.nodes[key].address
+	if attempts != nil {
+		attempts.add(address)
+	}
+	b.metrics.recordPick(b.id, info.FullMethodName, address, nil)
+	start := time.Now()
+
+	return balancer.PickResult{
+		SubConn: b.subConns[address],
+		Done: func(info balancer.DoneInfo) {
+			latency := time.Since(start)
+			b.metrics.recordDone(b.id, address, latency, info.Err)
+			b.outlier.recordDone(address, latency, info.Err)
+		},
+	}, nil
+}
 
+// updatePicker публикует балансировщик как picker, чтобы gRPC перевыбрал SubConn для ожидающих запросов.
+func (b *customBalancer) updatePicker() {
 	b.mu.RLock()
-	nodesCopy := make([]Node, 0, len(b.nodes))
-	for _, backend := range b.nodes {
-		nodesCopy = append(nodesCopy, backend)
+	state := connectivity.TransientFailure
+	for _, node := range b.nodes {
+		if b.available(node) {
+			state = connectivity.Ready
+			break
+		}
+		if _, exists := b.subConns[node.address]; exists && node.state != Open {
+			state = connectivity.Connecting
+		}
 	}
 	b.mu.RUnlock()
 
-	for key := range nodesCopy {
-		b.mu.RLock()
-		nodeState := b.nodes[key].state
-		nodeAddress := b.nodes[key].address
-		b.mu.RUnlock()
-		if nodeState == Open {
-			b.wg.Add(1)
-			go func() {
-				defer b.wg.Done()
+	b.cc.UpdateState(balancer.State{ConnectivityState: state, Picker: b})
+}
 
-				b.mu.RLock()
-				hcInt := b.cfg.HealthCheckInterval
-				hcTimeout := b.cfg.HealthCheckTimeout
-				maxRetries := b.cfg.MaxFails
-				b.mu.RUnlock()
+func (b *customBalancer) ExitIdle() {
 
-				timerInt := time.NewTicker(hcInt)
-				hc := HealthCheckerEx{timeout: hcTimeout}
+}
+
+// ResolverError вызывается gRPC, когда resolver сообщает об ошибке. Пример ошибки: проблема с резолвингом адресов.
+// При этом необходимо пройтись по всем адресам и позапускать health check-и, чтобы проверить, что бэкенды доступны и работают.
+func (b *customBalancer) ResolverError(err error) {
+
+	// горутины health-check-ов ищут ноду по адресу при каждом обращении: пока они работают,
+	// UpdateClientConnState может заменить b.nodes на другой, в том числе более короткий, список
+	b.mu.RLock()
+	openAddresses := make([]string, 0, len(b.nodes))
+	for _, node := range b.nodes {
+		if node.state == Open {
+			openAddresses = append(openAddresses, node.address)
+		}
+	}
+	b.mu.RUnlock()
 
-				defer timerInt.Stop()
-
-				for {
-					select {
-					case <-timerInt.C:
-						state, err := hc.Check(nodeAddress)
-						if err == nil {
-							b.mu.Lock()
-							b.nodes[key].rate++
-							defer b.mu.Unlock()
-							if b.nodes[key].rate/2 > b.nodes[key].amountOfErrors {
-								b.nodes[key].state = HalfOpen
-								b.nodes[key].maxRates = 20
-							} else {
-								b.nodes[key].state = Closed
-								b.nodes[key].maxRates = -1
-							}
-							address := resolver.Address{Addr: b.nodes[key].address}
-							subConn, err := b.cc.NewSubConn([]resolver.Address{address}, balancer.NewSubConnOptions{})
-							if err != nil {
-								b.nodes[key].state = Open
-								b.nodes[key].timer = *time.NewTicker(10 * time.Second)
-								return
-							} else {
-								b.subConns[b.nodes[key].address] = subConn
-							}
-							b.nodes[key].rate = 0
-							b.nodes[key].amountOfErrors = 0
-							b.nodes[key].timer.Stop()
+	for _, nodeAddress := range openAddresses {
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+
+			b.mu.RLock()
+			hcInt := b.cfg.HealthCheckInterval
+			hcTimeout := b.cfg.HealthCheckTimeout
+			maxRetries := b.cfg.MaxFails
+			b.mu.RUnlock()
+
+			timerInt := time.NewTicker(hcInt)
+			hc := HealthCheckerEx{timeout: hcTimeout, metrics: b.metrics, balancer: b.id}
+
+			defer timerInt.Stop()
+
+			for {
+				select {
+				case <-timerInt.C:
+					state, err := hc.Check(nodeAddress)
+					if err == nil {
+						b.mu.Lock()
+						defer b.mu.Unlock()
+						node := b.nodeByAddress(nodeAddress)
+						if node == nil {
 							return
 						}
-						if err != nil || !state {
-							maxRetries--
-							b.mu.Lock()
-							b.nodes[key].amountOfErrors++
-							b.nodes[key].rate++
-							b.mu.Unlock()
-							if maxRetries == 0 {
-								b.mu.Lock()
-								b.nodes[key].rate = 0
-								b.nodes[key].amountOfErrors = 0
-								b.nodes[key].state = Open
-								b.nodes[key].timer = *time.NewTicker(10 * time.Second)
-								delete(b.subConns, b.nodes[key].address)
-								b.mu.Unlock()
-								return
-							}
+						node.rate++
+						if node.rate/2 > node.amountOfErrors {
+							b.setState(node, HalfOpen)
+							node.maxRates = 20
+						} else {
+							b.setState(node, Closed)
+							node.maxRates = -1
+						}
+						address := resolver.Address{Addr: node.address}
+						subConn, err := b.cc.NewSubConn([]resolver.Address{address}, balancer.NewSubConnOptions{})
+						if err != nil {
+							b.openCircuit(node)
+							return
+						} else {
+							b.subConns[node.address] = subConn
+							subConn.Connect()
 						}
-						hcInt *= 2
-						timerInt.Reset(hcInt)
-					case <-b.stopChan:
+						node.rate = 0
+						node.amountOfErrors = 0
+						stopTimer(node)
 						return
 					}
+					if err != nil || !state {
+						maxRetries--
+						b.mu.Lock()
+						node := b.nodeByAddress(nodeAddress)
+						if node == nil {
+							b.mu.Unlock()
+							return
+						}
+						node.amountOfErrors++
+						node.rate++
+						if maxRetries == 0 {
+							node.rate = 0
+							node.amountOfErrors = 0
+							b.openCircuit(node)
+							delete(b.subConns, node.address)
+							b.mu.Unlock()
+							return
+						}
+						b.mu.Unlock()
+					}
+					hcInt *= 2
+					timerInt.Reset(hcInt)
+				case <-b.stopChan:
+					return
 				}
+			}
 
-			}()
-		}
+		}()
 	}
 }
 
 // Вызывается gRPC при изменении состояния ClientConn, например,
 // когда resolver предоставляет новые адреса бэкендов или обновляется конфигурация балансировки.
 // Для текущей задачи - это ResolveNow
-func (b customBalancer) UpdateClientConnState(resolverBal balancer.ClientConnState) error {
+func (b *customBalancer) UpdateClientConnState(resolverBal balancer.ClientConnState) error {
 
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 
-	nodes := make([]Node, 0)
-	for _, node := range resolverBal.ResolverState.Addresses {
+	addresses := subsetAddresses(resolverBal.ResolverState.Addresses, b.cfg.SubsetSize, b.cfg.ClientID)
+
+	b.mu.RLock()
+	known := make(map[string]struct{}, len(b.nodes))
+	for _, node := range b.nodes {
+		known[node.address] = struct{}{}
+	}
+	b.mu.RUnlock()
+
+	// health-check и новые SubConn нужны только для адресов, которых раньше не было.
+	// Ноды, оставшиеся в подмножестве, переиспользуются вместе с SubConn и состоянием circuit breaker-а,
+	// поэтому изменение списка адресов не разрывает уже установленные соединения
+	newNodes := make(map[string]Node)
+	newSubConns := make(map[string]balancer.SubConn)
+	// метрики новой ноды заводятся вместе с ней, поэтому результат первого health-check-а учитывается после этого
+	checks := make(map[string]error)
+	for _, node := range addresses {
+		if _, exists := known[node.Addr]; exists {
+			continue
+		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -328,27 +515,34 @@ func (b customBalancer) UpdateClientConnState(resolverBal balancer.ClientConnSta
 				hcTimeout := b.cfg.HealthCheckTimeout
 				b.mu.RUnlock()
 				hc := HealthCheckerEx{timeout: hcTimeout}
-				nodeInfo := Node{address: node.Addr, state: Closed, amountOfErrors: 0}
+				nodeInfo := Node{
+					address:        node.Addr,
+					state:          Closed,
+					amountOfErrors: 0,
+				}
 
 				state, err := hc.Check(node.Addr)
+				mu.Lock()
+				checks[node.Addr] = err
+				mu.Unlock()
 				if !state || err != nil {
 					nodeInfo.state = Open
-					nodeInfo.timer = *time.NewTicker(10 * time.Second)
+					nodeInfo.timer = time.NewTicker(openCircuitTimeout)
 				} else {
 					nodeInfo.rate++
 					address := resolver.Address{Addr: node.Addr}
 					subConn, err := b.cc.NewSubConn([]resolver.Address{address}, balancer.NewSubConnOptions{})
 					if err != nil {
 						nodeInfo.state = Open
-						nodeInfo.timer = *time.NewTicker(10 * time.Second)
+						nodeInfo.timer = time.NewTicker(openCircuitTimeout)
 					} else {
 						mu.Lock()
-						b.subConns[node.Addr] = subConn
+						newSubConns[node.Addr] = subConn
 						mu.Unlock()
 					}
 				}
 				mu.Lock()
-				nodes = append(nodes, nodeInfo)
+				newNodes[node.Addr] = nodeInfo
 				mu.Unlock()
 			}
 		}()
@@ -357,28 +551,100 @@ func (b customBalancer) UpdateClientConnState(resolverBal balancer.ClientConnSta
 	wg.Wait()
 
 	b.mu.Lock()
+	nodes := make([]Node, 0, len(addresses))
+	for _, address := range addresses {
+		node, exists := newNodes[address.Addr]
+		if !exists {
+			current := b.nodeByAddress(address.Addr)
+			if current == nil {
+				continue
+			}
+			// тикер хранится по указателю, поэтому копия ноды продолжает работать с тем же таймером
+			node = *current
+		}
+		node.weight = WeightFromAddress(address)
+		node.zone = ZoneFromAddress(address)
+		node.version = VersionFromAddress(address)
+		nodes = append(nodes, node)
+	}
+
+	for address, subConn := range newSubConns {
+		b.subConns[address] = subConn
+	}
+	for address, subConn := range b.subConns {
+		if !slices.ContainsFunc(nodes, func(node Node) bool { return node.address == address }) {
+			subConn.Shutdown()
+			delete(b.subConns, address)
+		}
+	}
+	for key := range b.nodes {
+		if !slices.ContainsFunc(nodes, func(node Node) bool { return node.address == b.nodes[key].address }) {
+			stopTimer(&b.nodes[key])
+		}
+	}
+
 	b.nodes = nodes
+	b.metrics.retain(b.id, nodes)
+	b.outlier.retain(nodes)
+	for _, node := range nodes {
+		b.metrics.recordNode(b.id, node)
+	}
+	for address, err := range checks {
+		b.metrics.recordHealthCheck(b.id, address, err)
+	}
+	for _, subConn := range newSubConns {
+		subConn.Connect()
+	}
 	b.mu.Unlock()
 
+	b.updatePicker()
+
 	return nil
 }
 
 // UpdateSubConnState вызывается gRPC при изменении состояния SubConn. Например, из Connecting в Transient_failure
-func (b customBalancer) UpdateSubConnState(subConn balancer.SubConn, s balancer.SubConnState) {
-	return
+func (b *customBalancer) UpdateSubConnState(subConn balancer.SubConn, s balancer.SubConnState) {
+	b.mu.Lock()
+	for address, sc := range b.subConns {
+		if sc != subConn {
+			continue
+		}
+		if node := b.nodeByAddress(address); node != nil {
+			node.ready = s.ConnectivityState == connectivity.Ready
+			b.metrics.recordReady(b.id, address, node.ready)
+		}
+		if s.ConnectivityState == connectivity.Idle {
+			subConn.Connect()
+		}
+	}
+	b.mu.Unlock()
+
+	b.updatePicker()
 }
 
-func (b customBalancer) Close() {
+func (b *customBalancer) Close() {
 	close(b.stopChan)
 	b.wg.Wait()
+
+	b.mu.Lock()
+	for key := range b.nodes {
+		stopTimer(&b.nodes[key])
+	}
+	b.mu.Unlock()
+	b.metrics.retain(b.id, nil)
 }
 
 type HealthCheckerEx struct {
-	timeout time.Duration
+	timeout  time.Duration
+	metrics  *balancerMetrics
+	balancer uint64 // номер балансировщика в метриках
 }
 
 func (hc *HealthCheckerEx) Check(addr string) (bool, error) {
 	conn, err := net.DialTimeout("tcp", addr, hc.timeout)
+	if hc.metrics != nil {
+		hc.metrics.recordHealthCheck(hc.balancer, addr, err)
+	}
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+)
+
+type fakeSubConn struct {
+	balancer.SubConn
+	address string
+}
+
+func (sc *fakeSubConn) Connect()  {}
+func (sc *fakeSubConn) Shutdown() {}
+
+type fakeClientConn struct {
+	balancer.ClientConn
+	subConns map[string]*fakeSubConn
+	state    connectivity.State
+	mu       sync.Mutex
+}
+
+func newFakeClientConn() *fakeClientConn {
+	return &fakeClientConn{subConns: make(map[string]*fakeSubConn)}
+}
+
+func (cc *fakeClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	sc := &fakeSubConn{address: addrs[0].Addr}
+	cc.subConns[sc.address] = sc
+	return sc, nil
+}
+
+func (cc *fakeClientConn) UpdateState(state balancer.State) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.state = state.ConnectivityState
+}
+
+func (cc *fakeClientConn) subConn(address string) *fakeSubConn {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.subConns[address]
+}
+
+// listen открывает TCP-порт, чтобы адрес проходил health-check.
+func listen(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+func pickZones(t *testing.T, bal *customBalancer, zones map[string]string, picks int) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for i := 0; i < picks; i++ {
+		result, err := bal.Pick(balancer.PickInfo{FullMethodName: "/test.Service/Get"})
+		if err != nil {
+			t.Fatalf("Pick: %v", err)
+		}
+		counts[zones[result.SubConn.(*fakeSubConn).address]]++
+	}
+	return counts
+}
+
+func TestZoneFailover(t *testing.T) {
+	zones := map[string]string{
+		listen(t): "eu-1a",
+		listen(t): "eu-1a",
+		listen(t): "eu-1b",
+		listen(t): "eu-1b",
+	}
+	addresses := make([]resolver.Address, 0, len(zones))
+	for addr, zone := range zones {
+		addresses = append(addresses, endpointToAddress(Endpoint{Addr: addr, Zone: zone}))
+	}
+
+	cc := newFakeClientConn()
+	builder := NewBuilder(BalancerConfig{
+		HealthCheckInterval:    time.Hour,
+		HealthCheckTimeout:     time.Second,
+		MaxFails:               3,
+		LocalZone:              "eu-1a",
+		MinLocalHealthyPercent: 60,
+	})
+	bal := builder.Build(cc, balancer.BuildOptions{}).(*customBalancer)
+	defer bal.Close()
+
+	if err := bal.UpdateClientConnState(balancer.ClientConnState{ResolverState: resolver.State{Addresses: addresses}}); err != nil {
+		t.Fatal(err)
+	}
+	for addr := range zones {
+		bal.UpdateSubConnState(cc.subConn(addr), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	}
+
+	counts := pickZones(t, bal, zones, 100)
+	if counts["eu-1a"] != 100 {
+		t.Fatalf("all healthy: want only local picks, got %v", counts)
+	}
+
+	// одна из двух локальных нод упала: здоровой емкости 50% < 60%, трафик уходит во все зоны
+	var localDown, localUp string
+	for addr, zone := range zones {
+		if zone != "eu-1a" {
+			continue
+		}
+		if localDown == "" {
+			localDown = addr
+		} else {
+			localUp = addr
+		}
+	}
+	bal.UpdateSubConnState(cc.subConn(localDown), balancer.SubConnState{ConnectivityState: connectivity.TransientFailure})
+
+	counts = pickZones(t, bal, zones, 90)
+	if counts["eu-1a"] != 30 || counts["eu-1b"] != 60 {
+		t.Fatalf("local zone degraded: want picks spread over 3 healthy nodes, got %v", counts)
+	}
+
+	// вся локальная зона недоступна
+	bal.UpdateSubConnState(cc.subConn(localUp), balancer.SubConnState{ConnectivityState: connectivity.TransientFailure})
+	counts = pickZones(t, bal, zones, 10)
+	if counts["eu-1b"] != 10 {
+		t.Fatalf("local zone down: want only remote picks, got %v", counts)
+	}
+
+	// зона восстановилась - трафик возвращается в нее
+	bal.UpdateSubConnState(cc.subConn(localDown), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	bal.UpdateSubConnState(cc.subConn(localUp), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	counts = pickZones(t, bal, zones, 10)
+	if counts["eu-1a"] != 10 {
+		t.Fatalf("local zone recovered: want only local picks, got %v", counts)
+	}
+}
+
+// Нода, не прошедшая первый health-check, восстанавливается через ResolverError,
+// пока список адресов меняется, а затем балансировщик закрывается.
+func TestResolverErrorRecoversOpenNode(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := ln.Addr().String()
+	ln.Close()
+	upAddr := listen(t)
+
+	cc := newFakeClientConn()
+	builder := NewBuilder(BalancerConfig{HealthCheckInterval: 20 * time.Millisecond, HealthCheckTimeout: time.Second, MaxFails: 100})
+	bal := builder.Build(cc, balancer.BuildOptions{}).(*customBalancer)
+
+	state := resolver.State{Addresses: []resolver.Address{{Addr: upAddr}, {Addr: downAddr}}}
+	if err := bal.UpdateClientConnState(balancer.ClientConnState{ResolverState: state}); err != nil {
+		t.Fatal(err)
+	}
+	bal.mu.RLock()
+	if node := bal.nodeByAddress(downAddr); node == nil || node.state != Open {
+		t.Fatalf("want %s to start with open circuit", downAddr)
+	}
+	bal.mu.RUnlock()
+
+	bal.ResolverError(nil)
+
+	// пока идут health-check-и, список адресов сокращается до одной ноды
+	reduced := resolver.State{Addresses: []resolver.Address{{Addr: downAddr}}}
+	if err := bal.UpdateClientConnState(balancer.ClientConnState{ResolverState: reduced}); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err = net.Listen("tcp", downAddr)
+	if err != nil {
+		t.Skipf("can not listen on %s again: %v", downAddr, err)
+	}
+	defer ln.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bal.mu.RLock()
+		node := bal.nodeByAddress(downAddr)
+		recovered := node != nil && node.state != Open
+		bal.mu.RUnlock()
+		if recovered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("node did not recover after ResolverError")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bal.Close()
+}
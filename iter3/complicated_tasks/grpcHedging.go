@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+
+Hedging и retry запросов для customBalancer.
+
+Для идемпотентных методов из HedgingConfig.Methods interceptor отправляет первую попытку и, если ответ
+не пришел за перцентиль latency этого метода, отправляет еще одну попытку. Попытки одного RPC помечаются
+в контексте, поэтому Pick отправляет каждую следующую попытку на ноду, на которую еще не ходили.
+Побеждает первый успешный ответ, остальные попытки отменяются. Если попытка завершилась с кодом из
+RetryableCodes, следующая попытка запускается сразу, не дожидаясь задержки.
+
+Hedge-попытки и retry расходуют общий retry budget: каждый обычный запрос добавляет BudgetRatio токена,
+каждая дополнительная попытка забирает один. Так при деградации всех нод hedging не удваивает нагрузку.
+
+Подключение:
+
+	hedger := NewHedger(HedgingConfig{Methods: map[string]HedgingPolicy{"/pkg.Service/Get": {}}})
+	conn, err := grpc.NewClient(target, grpc.WithUnaryInterceptor(hedger.UnaryClientInterceptor()), ...)
+
+*/
+
+const (
+	latencyWindowSize  = 256 // сколько последних latency метода хранится для расчета перцентиля
+	latencyMinSamples  = 20  // до накопления такого количества замеров используется MinDelay
+	defaultHedgeBudget = 10
+)
+
+type HedgingPolicy struct {
+	MaxAttempts    int           // всего попыток, включая первую. По умолчанию 2
+	Percentile     float64       // перцентиль latency метода, после которого отправляется hedge-попытка. По умолчанию 95
+	MinDelay       time.Duration // нижняя граница задержки, она же используется, пока статистики мало. По умолчанию 10ms
+	RetryableCodes []codes.Code  // по умолчанию Unavailable
+}
+
+type HedgingConfig struct {
+	Methods     map[string]HedgingPolicy // ключ - полное имя метода (/package.Service/Method). Только идемпотентные методы!
+	BudgetRatio float64                  // сколько токенов бюджета добавляет каждый запрос. По умолчанию 0.1
+	MaxBudget   int                      // максимальный запас токенов бюджета. По умолчанию 10
+}
+
+type Hedger struct {
+	cfg       HedgingConfig
+	latencies map[string]*latencyWindow
+	budget    *retryBudget
+	mu        *sync.Mutex
+}
+
+func NewHedger(cfg HedgingConfig) *Hedger {
+	methods := make(map[string]HedgingPolicy, len(cfg.Methods))
+	for method, policy := range cfg.Methods {
+		if policy.MaxAttempts < 2 {
+			policy.MaxAttempts = 2
+		}
+		if policy.Percentile <= 0 || policy.Percentile > 100 {
+			policy.Percentile = 95
+		}
+		if policy.MinDelay <= 0 {
+			policy.MinDelay = 10 * time.Millisecond
+		}
+		if len(policy.RetryableCodes) == 0 {
+			policy.RetryableCodes = []codes.Code{codes.Unavailable}
+		}
+		methods[method] = policy
+	}
+	cfg.Methods = methods
+
+	if cfg.BudgetRatio <= 0 {
+		cfg.BudgetRatio = 0.1
+	}
+	if cfg.MaxBudget <= 0 {
+		cfg.MaxBudget = defaultHedgeBudget
+	}
+
+	return &Hedger{
+		cfg:       cfg,
+		latencies: make(map[string]*latencyWindow),
+		budget:    &retryBudget{tokens: float64(cfg.MaxBudget), max: float64(cfg.MaxBudget), ratio: cfg.BudgetRatio, mu: &sync.Mutex{}},
+		mu:        &sync.Mutex{},
+	}
+}
+
+type attemptResult struct {
+	attempt int // номер попытки, 0 - первая
+	reply   proto.Message
+	opts    *attemptOptions
+	err     error
+	latency time.Duration
+}
+
+// attemptOptions - CallOption-ы вызывающего для одной попытки. gRPC записывает заголовки, трейлеры и peer
+// по указателям из CallOption-ов, поэтому у каждой попытки свои указатели, а вызывающему копируется
+// результат только той попытки, которой завершился RPC.
+type attemptOptions struct {
+	opts    []grpc.CallOption
+	header  metadata.MD
+	trailer metadata.MD
+	peer    peer.Peer
+}
+
+func newAttemptOptions(callerOpts []grpc.CallOption) *attemptOptions {
+	a := &attemptOptions{opts: make([]grpc.CallOption, 0, len(callerOpts))}
+	for _, opt := range callerOpts {
+		switch opt.(type) {
+		case grpc.HeaderCallOption:
+			opt = grpc.Header(&a.header)
+		case grpc.TrailerCallOption:
+			opt = grpc.Trailer(&a.trailer)
+		case grpc.PeerCallOption:
+			opt = grpc.Peer(&a.peer)
+		}
+		a.opts = append(a.opts, opt)
+	}
+	return a
+}
+
+// apply копирует заголовки, трейлеры и peer попытки в CallOption-ы вызывающего.
+func (a *attemptOptions) apply(callerOpts []grpc.CallOption) {
+	for _, opt := range callerOpts {
+		switch opt := opt.(type) {
+		case grpc.HeaderCallOption:
+			*opt.HeaderAddr = a.header
+		case grpc.TrailerCallOption:
+			*opt.TrailerAddr = a.trailer
+		case grpc.PeerCallOption:
+			*opt.PeerAddr = a.peer
+		}
+	}
+}
+
+func (h *Hedger) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		policy, hedged := h.cfg.Methods[method]
+		replyMsg, isProto := reply.(proto.Message)
+		if !hedged || !isProto {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		h.budget.deposit()
+
+		// отмена общего контекста при выходе отменяет все проигравшие попытки
+		ctx, cancel := context.WithCancel(context.WithValue(ctx, hedgeKey{}, &hedgeAttempts{}))
+		defer cancel()
+
+		results := make(chan attemptResult, policy.MaxAttempts)
+		launched, pending := 0, 0
+		launch := func() {
+			// у каждой попытки свой ответ, иначе попытки будут одновременно писать в reply
+			attemptReply := replyMsg.ProtoReflect().New().Interface()
+			attemptOpts := newAttemptOptions(opts)
+			attempt := launched
+			go func() {
+				start := time.Now()
+				err := invoker(ctx, method, req, attemptReply, cc, attemptOpts.opts...)
+				results <- attemptResult{attempt: attempt, reply: attemptReply, opts: attemptOpts, err: err, latency: time.Since(start)}
+			}()
+		}
+
+		start := time.Now()
+		firstDone := false
+		launch()
+		launched, pending = 1, 1
+		delay := h.delay(method, policy)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		var last attemptResult
+		for {
+			select {
+			case <-timer.C:
+				if launched < policy.MaxAttempts && h.budget.withdraw() {
+					launch()
+					launched++
+					pending++
+					timer.Reset(delay)
+				}
+			case result := <-results:
+				pending--
+				if result.attempt == 0 {
+					firstDone = true
+				}
+				if result.err == nil {
+					// перцентиль считается по latency первых попыток. Если победила hedge-попытка, первая
+					// еще не ответила, и время с начала RPC - нижняя граница ее latency. Latency самой
+					// победившей попытки занижала бы перцентиль, и hedge-попытки уходили бы все раньше
+					switch {
+					case result.attempt == 0:
+						h.observe(method, result.latency)
+					case !firstDone:
+						h.observe(method, time.Since(start))
+					}
+					proto.Reset(replyMsg)
+					proto.Merge(replyMsg, result.reply)
+					result.opts.apply(opts)
+					return nil
+				}
+				last = result
+				retryable := slices.Contains(policy.RetryableCodes, status.Code(result.err))
+				if retryable && ctx.Err() == nil && launched < policy.MaxAttempts && h.budget.withdraw() {
+					launch()
+					launched++
+					pending++
+					continue
+				}
+				if pending == 0 {
+					last.opts.apply(opts)
+					return last.err
+				}
+			}
+		}
+	}
+}
+
+// delay возвращает задержку перед hedge-попыткой: перцентиль latency метода, но не меньше MinDelay.
+func (h *Hedger) delay(method string, policy HedgingPolicy) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	window, exists := h.latencies[method]
+	if !exists {
+		return policy.MinDelay
+	}
+	return max(window.percentile(policy.Percentile), policy.MinDelay)
+}
+
+func (h *Hedger) observe(method string, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	window, exists := h.latencies[method]
+	if !exists {
+		window = &latencyWindow{samples: make([]time.Duration, 0, latencyWindowSize)}
+		h.latencies[method] = window
+	}
+	window.add(latency)
+}
+
+// latencyWindow - кольцевой буфер последних latency метода.
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) add(latency time.Duration) {
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, latency)
+	} else {
+		w.samples[w.next] = latency
+	}
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+func (w *latencyWindow) percentile(p float64) time.Duration {
+	if len(w.samples) < latencyMinSamples {
+		return 0
+	}
+	sorted := slices.Clone(w.samples)
+	slices.Sort(sorted)
+	idx := int(float64(len(sorted)-1) * p / 100)
+	return sorted[idx]
+}
+
+type retryBudget struct {
+	tokens float64
+	max    float64
+	ratio  float64
+	mu     *sync.Mutex
+}
+
+func (rb *retryBudget) deposit() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.tokens = min(rb.max, rb.tokens+rb.ratio)
+}
+
+func (rb *retryBudget) withdraw() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.tokens < 1 {
+		return false
+	}
+	rb.tokens--
+	return true
+}
+
+// hedgeAttempts хранится в контексте RPC и запоминает ноды, на которые уже ушли попытки этого RPC.
+type hedgeKey struct{}
+
+type hedgeAttempts struct {
+	addresses []string
+	mu        sync.Mutex
+}
+
+func (a *hedgeAttempts) add(address string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.addresses = append(a.addresses, address)
+}
+
+func (a *hedgeAttempts) used(address string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Contains(a.addresses, address)
+}
+
+// excludeAttempted убирает из кандидатов ноды, на которые уже ходили попытки этого RPC.
+// Если других нод не осталось, возвращает кандидатов без изменений. Вызывать под мьютексом балансировщика.
+func (b *customBalancer) excludeAttempted(candidates []int, attempts *hedgeAttempts) []int {
+	if attempts == nil {
+		return candidates
+	}
+	fresh := slices.DeleteFunc(slices.Clone(candidates), func(key int) bool {
+		return attempts.used(b.nodes[key].address)
+	})
+	if len(fresh) == 0 {
+		return candidates
+	}
+	return fresh
+}
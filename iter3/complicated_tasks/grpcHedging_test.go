@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const latencyMethod = "/test.Latency/Get"
+
+// latencyServer - in-process gRPC-сервер, который отвечает на call-й вызов через delay(call)
+// или сразу возвращает ошибку fail(call).
+type latencyServer struct {
+	calls atomic.Int32
+	delay func(call int32) time.Duration
+	fail  func(call int32) error
+}
+
+func (s *latencyServer) get(ctx context.Context, dec func(any) error) (any, error) {
+	in := &emptypb.Empty{}
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	call := s.calls.Add(1)
+	if s.fail != nil {
+		if err := s.fail(call); err != nil {
+			return nil, err
+		}
+	}
+	if s.delay != nil {
+		select {
+		case <-time.After(s.delay(call)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return wrapperspb.String("ok"), nil
+}
+
+func startLatencyServer(t *testing.T, srv *latencyServer, hedger *Hedger) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Latency",
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Get",
+			Handler: func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				return srv.get(ctx, dec)
+			},
+		}},
+	}, nil)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(hedger.UnaryClientInterceptor()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func invokeLatency(conn *grpc.ClientConn) (time.Duration, error) {
+	start := time.Now()
+	reply := &wrapperspb.StringValue{}
+	err := conn.Invoke(context.Background(), latencyMethod, &emptypb.Empty{}, reply)
+	if err == nil && reply.GetValue() != "ok" {
+		err = status.Error(codes.Internal, "unexpected reply "+reply.GetValue())
+	}
+	return time.Since(start), err
+}
+
+func TestHedgeWinsOverSlowAttempt(t *testing.T) {
+	srv := &latencyServer{delay: func(call int32) time.Duration {
+		if call == 1 {
+			return 2 * time.Second
+		}
+		return 0
+	}}
+	hedger := NewHedger(HedgingConfig{Methods: map[string]HedgingPolicy{latencyMethod: {MinDelay: 50 * time.Millisecond}}})
+	conn := startLatencyServer(t, srv, hedger)
+
+	elapsed, err := invokeLatency(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed >= time.Second {
+		t.Fatalf("want hedge attempt to answer before the slow one, took %v", elapsed)
+	}
+	if calls := srv.calls.Load(); calls != 2 {
+		t.Fatalf("want 2 attempts, got %d", calls)
+	}
+
+	// первая попытка не ответила, поэтому в статистику попадает время с начала RPC, а не latency hedge-попытки
+	hedger.mu.Lock()
+	samples := hedger.latencies[latencyMethod].samples
+	hedger.mu.Unlock()
+	if len(samples) != 1 || samples[0] < 50*time.Millisecond {
+		t.Fatalf("want one sample of at least hedge delay, got %v", samples)
+	}
+}
+
+func TestHedgeDelayFollowsFirstAttemptLatency(t *testing.T) {
+	// каждая нечетная попытка (первая в RPC) медленная, hedge-попытка отвечает сразу
+	srv := &latencyServer{delay: func(call int32) time.Duration {
+		if call%2 == 1 {
+			return 500 * time.Millisecond
+		}
+		return 0
+	}}
+	minDelay := 20 * time.Millisecond
+	hedger := NewHedger(HedgingConfig{Methods: map[string]HedgingPolicy{latencyMethod: {MinDelay: minDelay}}, BudgetRatio: 1})
+	conn := startLatencyServer(t, srv, hedger)
+
+	for i := 0; i < latencyMinSamples; i++ {
+		if _, err := invokeLatency(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// latency победивших hedge-попыток не должна сдвигать перцентиль ниже задержки, после которой они отправлялись
+	hedger.mu.Lock()
+	percentile := hedger.latencies[latencyMethod].percentile(95)
+	hedger.mu.Unlock()
+	if percentile < minDelay {
+		t.Fatalf("latency percentile drifted below hedge delay: %v", percentile)
+	}
+}
+
+func TestRetryOnRetryableCode(t *testing.T) {
+	srv := &latencyServer{fail: func(call int32) error {
+		if call == 1 {
+			return status.Error(codes.Unavailable, "node is down")
+		}
+		return nil
+	}}
+	hedger := NewHedger(HedgingConfig{Methods: map[string]HedgingPolicy{latencyMethod: {MinDelay: time.Second}}})
+	conn := startLatencyServer(t, srv, hedger)
+
+	elapsed, err := invokeLatency(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed >= 500*time.Millisecond {
+		t.Fatalf("want retry without waiting for hedge delay, took %v", elapsed)
+	}
+	if calls := srv.calls.Load(); calls != 2 {
+		t.Fatalf("want 2 attempts, got %d", calls)
+	}
+}
+
+func TestHedgeBudgetExhausted(t *testing.T) {
+	srv := &latencyServer{delay: func(call int32) time.Duration {
+		if call == 1 || call == 3 {
+			return 200 * time.Millisecond
+		}
+		return 0
+	}}
+	hedger := NewHedger(HedgingConfig{
+		Methods:     map[string]HedgingPolicy{latencyMethod: {MinDelay: 10 * time.Millisecond}},
+		BudgetRatio: 0.01,
+		MaxBudget:   1,
+	})
+	conn := startLatencyServer(t, srv, hedger)
+
+	if elapsed, err := invokeLatency(conn); err != nil || elapsed >= 200*time.Millisecond {
+		t.Fatalf("first RPC should be hedged: %v, %v", elapsed, err)
+	}
+	// бюджет израсходован - второй RPC ждет медленную первую попытку
+	if elapsed, err := invokeLatency(conn); err != nil || elapsed < 200*time.Millisecond {
+		t.Fatalf("second RPC should not be hedged: %v, %v", elapsed, err)
+	}
+	if calls := srv.calls.Load(); calls != 3 {
+		t.Fatalf("want 3 attempts, got %d", calls)
+	}
+}
+
+const plainMethod = "/test.Latency/Plain"
+
+// nodeServer - один из бэкендов за customBalancer. Каждый ответ помечается заголовком node с адресом бэкенда.
+// Бэкенд, первым получивший вызов latencyMethod, зависает на всех вызовах этого метода.
+type nodeServer struct {
+	addr  string
+	stuck *atomic.Pointer[string]
+	calls atomic.Int32
+}
+
+func (s *nodeServer) handle(method string) func(any, context.Context, func(any) error, grpc.UnaryServerInterceptor) (any, error) {
+	return func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+		if err := dec(&emptypb.Empty{}); err != nil {
+			return nil, err
+		}
+		grpc.SetHeader(ctx, metadata.Pairs("node", s.addr))
+		grpc.SetTrailer(ctx, metadata.Pairs("node", s.addr))
+		if method == latencyMethod {
+			s.calls.Add(1)
+			s.stuck.CompareAndSwap(nil, &s.addr)
+			if *s.stuck.Load() == s.addr {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+		}
+		return wrapperspb.String("ok"), nil
+	}
+}
+
+// startBalancedNodes запускает бэкенды на TCP-портах и клиент, который ходит к ним через
+// MemoryRegistry, customBalancer и hedging interceptor.
+func startBalancedNodes(t *testing.T, count int, hedger *Hedger) (*grpc.ClientConn, map[string]*nodeServer) {
+	t.Helper()
+	var stuck atomic.Pointer[string]
+	nodes := make(map[string]*nodeServer, count)
+	endpoints := make([]Endpoint, 0, count)
+	for i := 0; i < count; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := &nodeServer{addr: lis.Addr().String(), stuck: &stuck}
+		server := grpc.NewServer()
+		server.RegisterService(&grpc.ServiceDesc{
+			ServiceName: "test.Latency",
+			HandlerType: (*any)(nil),
+			Methods: []grpc.MethodDesc{
+				{MethodName: "Get", Handler: node.handle(latencyMethod)},
+				{MethodName: "Plain", Handler: node.handle(plainMethod)},
+			},
+		}, nil)
+		go server.Serve(lis)
+		t.Cleanup(server.Stop)
+		nodes[node.addr] = node
+		endpoints = append(endpoints, Endpoint{Addr: node.addr})
+	}
+
+	balancer.Register(NewBuilder(BalancerConfig{HealthCheckInterval: time.Hour, HealthCheckTimeout: time.Second, MaxFails: 3}))
+	conn, err := grpc.NewClient("hedgetest:///nodes",
+		grpc.WithResolvers(NewResolverBuilder(ResolverConfig{Scheme: "hedgetest"}, NewMemoryRegistry(endpoints...))),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"customGRPCBalancer": {}}]}`),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(hedger.UnaryClientInterceptor()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// ждем, пока все SubConn подключатся и round-robin начнет ходить на каждый бэкенд
+	seen := make(map[string]bool, count)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(seen) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("not all backends became ready, seen %v", seen)
+		}
+		seen[invokePlain(t, conn)] = true
+	}
+	return conn, nodes
+}
+
+// invokePlain делает вызов без hedging-а и возвращает адрес ответившего бэкенда.
+func invokePlain(t *testing.T, conn *grpc.ClientConn) string {
+	t.Helper()
+	var header metadata.MD
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Invoke(ctx, plainMethod, &emptypb.Empty{}, &wrapperspb.StringValue{}, grpc.Header(&header), grpc.WaitForReady(true)); err != nil {
+		t.Fatal(err)
+	}
+	return header.Get("node")[0]
+}
+
+func TestHedgeGoesToAnotherNode(t *testing.T) {
+	hedger := NewHedger(HedgingConfig{Methods: map[string]HedgingPolicy{latencyMethod: {MinDelay: 300 * time.Millisecond, MaxAttempts: 3}}})
+	conn, nodes := startBalancedNodes(t, 2, hedger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var (
+		header  metadata.MD
+		trailer metadata.MD
+		p       peer.Peer
+		err     error
+		wg      sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = conn.Invoke(ctx, latencyMethod, &emptypb.Empty{}, &wrapperspb.StringValue{}, grpc.Header(&header), grpc.Trailer(&trailer), grpc.Peer(&p))
+	}()
+
+	var stuck *nodeServer
+	deadline := time.Now().Add(5 * time.Second)
+	for stuck == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("first attempt did not reach any backend")
+		}
+		for _, node := range nodes {
+			if node.calls.Load() > 0 {
+				stuck = node
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// вызов без hedging-а сдвигает round-robin: без исключения уже использованных нод
+	// hedge-попытка снова попала бы на зависший бэкенд
+	if addr := invokePlain(t, conn); addr == stuck.addr {
+		t.Fatalf("plain call should go to the other backend, got %s", addr)
+	}
+
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("hedged RPC failed: %v", err)
+	}
+	if calls := stuck.calls.Load(); calls != 1 {
+		t.Fatalf("want one attempt on the stuck backend, got %d", calls)
+	}
+	// заголовки, трейлеры и peer вызывающего берутся из победившей попытки, а проигравшая
+	// попытка, которая завершается уже после возврата из Invoke, в них не пишет
+	time.Sleep(50 * time.Millisecond)
+	winner := header.Get("node")
+	if len(winner) != 1 || winner[0] == stuck.addr || nodes[winner[0]] == nil {
+		t.Fatalf("want header from the hedge attempt, got %v", winner)
+	}
+	if got := trailer.Get("node"); len(got) != 1 || got[0] != winner[0] {
+		t.Fatalf("want trailer from the hedge attempt %s, got %v", winner[0], got)
+	}
+	if p.Addr == nil || p.Addr.String() != winner[0] {
+		t.Fatalf("want peer of the hedge attempt %s, got %v", winner[0], p.Addr)
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+/*
+
+Метрики состояния нод для customBalancer.
+
+Для каждой ноды собираются RED-метрики (количество запросов, ошибки по gRPC-кодам, гистограмма latency),
+состояние circuit breaker-а и количество переходов между состояниями, результаты health-check-ов.
+Метрики общие для builder-а и всех построенных им балансировщиков, поэтому снимать их можно через
+builder, который вернул NewBuilder. Ноды разных балансировщиков (ClientConn-ов) учитываются отдельно,
+даже если у них одинаковые адреса: в выдаче они различаются по номеру балансировщика.
+
+	builder := NewBuilder(cfg)
+	http.Handle("/metrics", builder.(MetricsProvider).MetricsHandler())
+	http.Handle("/debug/balancer", builder.(MetricsProvider).AdminHandler())
+
+*/
+
+const (
+	pickHistorySize = 100 // сколько последних pick-ов хранится для admin-дампа
+	rateWindow      = 60  // окно в секундах, по которому считается request rate
+)
+
+// границы бакетов гистограммы latency в секундах (как у Prometheus по умолчанию)
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type MetricsProvider interface {
+	Snapshot() BalancerSnapshot
+	MetricsHandler() http.Handler
+	AdminHandler() http.Handler
+}
+
+type LatencyHistogram struct {
+	Bounds []float64 `json:"bounds"` // верхние границы бакетов в секундах
+	Counts []uint64  `json:"counts"` // количество запросов в каждом бакете, последний - +Inf
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+type NodeSnapshot struct {
+	Balancer            uint64            `json:"balancer"` // номер балансировщика builder-а, которому принадлежит нода
+	Address             string            `json:"address"`
+	Zone                string            `json:"zone"`
+	State               string            `json:"state"`
+	Ready               bool              `json:"ready"`
+	Requests            uint64            `json:"requests"`
+	RequestRate         float64           `json:"request_rate"` // запросов в секунду за последнюю минуту
+	Errors              uint64            `json:"errors"`
+	ErrorsByCode        map[string]uint64 `json:"errors_by_code"`
+	Latency             LatencyHistogram  `json:"latency"`
+	StateTransitions    uint64            `json:"state_transitions"`
+	LastTransition      time.Time         `json:"last_transition"`
+	HealthChecks        uint64            `json:"health_checks"`
+	HealthCheckFailures uint64            `json:"health_check_failures"`
+	LastHealthCheck     time.Time         `json:"last_health_check"`
+	LastHealthCheckErr  string            `json:"last_health_check_error,omitempty"`
+	Ejected             bool              `json:"ejected"` // нода исключена outlier detection-ом
+	Ejections           uint64            `json:"ejections"`
+}
+
+type PickRecord struct {
+	Time     time.Time `json:"time"`
+	Balancer uint64    `json:"balancer"`
+	Method   string    `json:"method"`
+	Address  string    `json:"address,omitempty"`
+	Err      string    `json:"error,omitempty"`
+}
+
+type BalancerSnapshot struct {
+	Nodes []NodeSnapshot `json:"nodes"`
+	Picks []PickRecord   `json:"picks"` // последние pick-и, от старых к новым
+}
+
+func (s nodeState) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+type nodeMetrics struct {
+	zone                string
+	state               nodeState
+	ready               bool
+	requests            uint64
+	recent              [rateWindow]uint64 // запросы по секундам, индекс - unix-время по модулю rateWindow
+	recentAt            [rateWindow]int64  // к какой секунде относится значение в recent
+	errors              uint64
+	errorsByCode        map[string]uint64
+	latencyCounts       []uint64
+	latencySum          float64
+	transitions         uint64
+	lastTransition      time.Time
+	healthChecks        uint64
+	healthCheckFailures uint64
+	lastHealthCheck     time.Time
+	lastHealthCheckErr  string
+	ejected             bool
+	ejections           uint64
+}
+
+// nodeKey - метрики ведутся по ноде каждого балансировщика отдельно: два ClientConn-а с общим адресом
+// не должны перетирать друг другу состояние circuit breaker-а и счетчики.
+type nodeKey struct {
+	balancer uint64
+	address  string
+}
+
+type balancerMetrics struct {
+	nodes        map[nodeKey]*nodeMetrics
+	lastBalancer uint64 // последний выданный номер балансировщика
+	picks        []PickRecord
+	nextPick     int
+	mu           *sync.Mutex
+}
+
+func newBalancerMetrics() *balancerMetrics {
+	return &balancerMetrics{
+		nodes: make(map[nodeKey]*nodeMetrics),
+		picks: make([]PickRecord, 0, pickHistorySize),
+		mu:    &sync.Mutex{},
+	}
+}
+
+// register выдает номер новому балансировщику builder-а.
+func (m *balancerMetrics) register() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastBalancer++
+	return m.lastBalancer
+}
+
+// node возвращает метрики ноды или nil, если нода уже удалена из балансировщика. Колбеки Done и
+// health-check-и могут прийти после удаления ноды, и они не должны заводить метрики заново.
+// Вызывать под мьютексом.
+func (m *balancerMetrics) node(balancer uint64, address string) *nodeMetrics {
+	return m.nodes[nodeKey{balancer: balancer, address: address}]
+}
+
+// recordNode заводит метрики ноды, если их еще нет, и обновляет статическую информацию о ней
+// без учета перехода состояния.
+func (m *balancerMetrics) recordNode(balancer uint64, node Node) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := nodeKey{balancer: balancer, address: node.address}
+	nm, exists := m.nodes[key]
+	if !exists {
+		nm = &nodeMetrics{
+			errorsByCode:  make(map[string]uint64),
+			latencyCounts: make([]uint64, len(latencyBuckets)+1),
+		}
+		m.nodes[key] = nm
+	}
+	nm.zone = node.zone
+	nm.state = node.state
+	nm.ready = node.ready
+}
+
+// retain удаляет метрики нод балансировщика, которых нет в текущем списке. nil вместо списка - балансировщик закрыт.
+func (m *balancerMetrics) retain(balancer uint64, nodes []Node) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.nodes {
+		if key.balancer != balancer {
+			continue
+		}
+		if !slices.ContainsFunc(nodes, func(node Node) bool { return node.address == key.address }) {
+			delete(m.nodes, key)
+		}
+	}
+}
+
+func (m *balancerMetrics) recordState(balancer uint64, address string, state nodeState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nm := m.node(balancer, address)
+	if nm == nil || nm.state == state {
+		return
+	}
+	nm.state = state
+	nm.transitions++
+	nm.lastTransition = time.Now()
+}
+
+func (m *balancerMetrics) recordReady(balancer uint64, address string, ready bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if nm := m.node(balancer, address); nm != nil {
+		nm.ready = ready
+	}
+}
+
+func (m *balancerMetrics) recordEjection(balancer uint64, address string, ejected bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nm := m.node(balancer, address)
+	if nm == nil {
+		return
+	}
+	nm.ejected = ejected
+	if ejected {
+		nm.ejections++
+	}
+}
+
+func (m *balancerMetrics) recordPick(balancer uint64, method, address string, err error) {
+	record := PickRecord{Time: time.Now(), Balancer: balancer, Method: method, Address: address}
+	if err != nil {
+		record.Err = err.Error()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.picks) < pickHistorySize {
+		m.picks = append(m.picks, record)
+	} else {
+		m.picks[m.nextPick] = record
+	}
+	m.nextPick = (m.nextPick + 1) % pickHistorySize
+}
+
+// recordDone вызывается из PickResult.Done, когда RPC завершился.
+func (m *balancerMetrics) recordDone(balancer uint64, address string, latency time.Duration, err error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nm := m.node(balancer, address)
+	if nm == nil {
+		return
+	}
+	nm.requests++
+
+	second := now.Unix()
+	idx := second % rateWindow
+	if nm.recentAt[idx] != second {
+		nm.recentAt[idx] = second
+		nm.recent[idx] = 0
+	}
+	nm.recent[idx]++
+
+	seconds := latency.Seconds()
+	bucket, _ := slices.BinarySearch(latencyBuckets, seconds)
+	nm.latencyCounts[bucket]++
+	nm.latencySum += seconds
+
+	if err != nil {
+		nm.errors++
+		nm.errorsByCode[status.Code(err).String()]++
+	}
+}
+
+func (m *balancerMetrics) recordHealthCheck(balancer uint64, address string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nm := m.node(balancer, address)
+	if nm == nil {
+		return
+	}
+	nm.healthChecks++
+	nm.lastHealthCheck = time.Now()
+	nm.lastHealthCheckErr = ""
+	if err != nil {
+		nm.healthCheckFailures++
+		nm.lastHealthCheckErr = err.Error()
+	}
+}
+
+func (m *balancerMetrics) snapshot() BalancerSnapshot {
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := BalancerSnapshot{
+		Nodes: make([]NodeSnapshot, 0, len(m.nodes)),
+		Picks: make([]PickRecord, 0, len(m.picks)),
+	}
+
+	for key, nm := range m.nodes {
+		var recent uint64
+		for idx := range nm.recent {
+			if now-nm.recentAt[idx] < rateWindow {
+				recent += nm.recent[idx]
+			}
+		}
+
+		var count uint64
+		for _, c := range nm.latencyCounts {
+			count += c
+		}
+
+		errorsByCode := make(map[string]uint64, len(nm.errorsByCode))
+		for code, amount := range nm.errorsByCode {
+			errorsByCode[code] = amount
+		}
+
+		snapshot.Nodes = append(snapshot.Nodes, NodeSnapshot{
+			Balancer:     key.balancer,
+			Address:      key.address,
+			Zone:         nm.zone,
+			State:        nm.state.String(),
+			Ready:        nm.ready,
+			Requests:     nm.requests,
+			RequestRate:  float64(recent) / rateWindow,
+			Errors:       nm.errors,
+			ErrorsByCode: errorsByCode,
+			Latency: LatencyHistogram{
+				Bounds: slices.Clone(latencyBuckets),
+				Counts: slices.Clone(nm.latencyCounts),
+				Sum:    nm.latencySum,
+				Count:  count,
+			},
+			StateTransitions:    nm.transitions,
+			LastTransition:      nm.lastTransition,
+			HealthChecks:        nm.healthChecks,
+			HealthCheckFailures: nm.healthCheckFailures,
+			LastHealthCheck:     nm.lastHealthCheck,
+			LastHealthCheckErr:  nm.lastHealthCheckErr,
+			Ejected:             nm.ejected,
+			Ejections:           nm.ejections,
+		})
+	}
+	sort.Slice(snapshot.Nodes, func(i, j int) bool {
+		if snapshot.Nodes[i].Balancer != snapshot.Nodes[j].Balancer {
+			return snapshot.Nodes[i].Balancer < snapshot.Nodes[j].Balancer
+		}
+		return snapshot.Nodes[i].Address < snapshot.Nodes[j].Address
+	})
+
+	// кольцевой буфер разворачиваем от старых pick-ов к новым
+	if len(m.picks) == pickHistorySize {
+		snapshot.Picks = append(snapshot.Picks, m.picks[m.nextPick:]...)
+		snapshot.Picks = append(snapshot.Picks, m.picks[:m.nextPick]...)
+	} else {
+		snapshot.Picks = append(snapshot.Picks, m.picks...)
+	}
+
+	return snapshot
+}
+
+func (b *customBalancer) Snapshot() BalancerSnapshot {
+	return b.metrics.snapshot()
+}
+
+// MetricsHandler отдает метрики нод в текстовом формате Prometheus.
+func (b *customBalancer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheus(w, b.name, b.Snapshot())
+	})
+}
+
+// AdminHandler отдает полный дамп состояния в JSON, включая то, на какую ноду ушел каждый из последних pick-ов.
+func (b *customBalancer) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(b.Snapshot())
+	})
+}
+
+func writePrometheus(w http.ResponseWriter, balancerName string, snapshot BalancerSnapshot) {
+	states := []nodeState{Open, HalfOpen, Closed}
+
+	fmt.Fprintln(w, "# HELP grpc_balancer_requests_total Number of RPCs finished on the node.")
+	fmt.Fprintln(w, "# TYPE grpc_balancer_requests_total counter")
+	for _, node := range snapshot.Nodes {
+		fmt.Fprintf(w, "grpc_balancer_requests_total{%s} %d\n", labels(balancerName, node), node.Requests)
+	}
+
+	fmt.Fprintln(w, "# HELP grpc_balancer_errors_total Number of RPCs finished with an error, by gRPC code.")
+	fmt.Fprintln(w, "# TYPE grpc_balancer_errors_total counter")
+	for _, node := range snapshot.Nodes {
+		codes := make([]string, 0, len(node.ErrorsByCode))
+		for code := range node.ErrorsByCode {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Fprintf(w, "grpc_balancer_errors_total{%s,code=%q} %d\n", labels(balancerName, node), code, node.ErrorsByCode[code])
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP grpc_balancer_request_duration_seconds RPC latency on the node.")
+	fmt.Fprintln(w, "# TYPE grpc_balancer_request_duration_seconds histogram")
+	for _, node := range snapshot.Nodes {
+		var cumulative uint64
+		for idx, bound := range node.Latency.Bounds {
+			cumulative += node.Latency.Counts[idx]
+			fmt.Fprintf(w, "grpc_balancer_request_duration_seconds_bucket{%s,le=%q} %d\n", labels(balancerName, node), fmt.Sprint(bound), cumulative)
+		}
+		fmt.Fprintf(w, "grpc_balancer_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(balancerName, node), node.Latency.Count)
+		fmt.Fprintf(w, "grpc_balancer_request_duration_seconds_sum{%s} %g\n", labels(balancerName, node), node.Latency.Sum)
+		fmt.Fprintf(w, "grpc_balancer_request_duration_seconds_count{%s} %d\n", labels(balancerName, node), node.Latency.Count)
+	}
+
+	fmt.Fprintln(w, "# HELP grpc_balancer_circuit_state Current circuit breaker state of the node (1 for the active state).")
+	fmt.Fprintln(w, "# TYPE grpc_balancer_circuit_state gauge")
+	for _, node := range snapshot.Nodes {
+		for _, state := range states {
+			value := 0
+			if node.State == state.String() {
+				value = 1
+			}
+			fmt.Fprintf(w, "grpc_balancer_circuit_state{%s,state=%q} %d\n", labels(balancerName, node), state.String(), value)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP grpc_balancer_circuit_transitions_total Number of circuit breaker state transitions.")
+	fmt.Fprintln(w, "# TYPE grpc_balancer_circuit_transitions_total counter")
+	for _, node := range snapshot.Nodes {
+		fmt.Fprintf(w, "grpc_balancer_circuit_transitions_total{%s} %d\n", labels(balancerName, node), node.StateTransitions)
+	}
+
+	fmt.Fprintln(w, "# HELP grpc_balancer_node_ready Whether the node SubConn is READY.")
+	fmt.Fprintln(w, "# TYPE grpc_balancer_node_ready gauge")
+	for _, node := range snapshot.Nodes {
+		value := 0
+		if node.Ready {
+			value = 1
+		}
+		fmt.Fprintf(w, "grpc_balancer_node_ready{%s} %d\n", labels(balancerName, node), value)
+	}
+
+	fmt.Fprintln(w, "# HELP grpc_balancer_outlier_ejected Whether the node is ejected by outlier detection.")
+	fmt.Fprintln(w, "# TYPE grpc_balancer_outlier_ejected gauge")
+	for _, node := range snapshot.Nodes {
+		value := 0
+		if node.Ejected {
+			value = 1
+		}
+		fmt.Fprintf(w, "grpc_balancer_outlier_ejected{%s} %d\n", labels(balancerName, node), value)
+	}
+
+	fmt.Fprintln(w, "# HELP grpc_balancer_outlier_ejections_total Number of outlier ejections of the node.")
+	fmt.Fprintln(w, "# TYPE grpc_balancer_outlier_ejections_total counter")
+	for _, node := range snapshot.Nodes {
+		fmt.Fprintf(w, "grpc_balancer_outlier_ejections_total{%s} %d\n", labels(balancerName, node), node.Ejections)
+	}
+
+	fmt.Fprintln(w, "# HELP grpc_balancer_health_checks_total Number of health checks, by result.")
+	fmt.Fprintln(w, "# TYPE grpc_balancer_health_checks_total counter")
+	for _, node := range snapshot.Nodes {
+		fmt.Fprintf(w, "grpc_balancer_health_checks_total{%s,result=\"success\"} %d\n", labels(balancerName, node), node.HealthChecks-node.HealthCheckFailures)
+		fmt.Fprintf(w, "grpc_balancer_health_checks_total{%s,result=\"failure\"} %d\n", labels(balancerName, node), node.HealthCheckFailures)
+	}
+}
+
+func labels(balancerName string, node NodeSnapshot) string {
+	return strings.Join([]string{
+		fmt.Sprintf("balancer=%q", balancerName),
+		fmt.Sprintf("conn=\"%d\"", node.Balancer),
+		fmt.Sprintf("node=%q", node.Address),
+		fmt.Sprintf("zone=%q", node.Zone),
+	}, ",")
+}
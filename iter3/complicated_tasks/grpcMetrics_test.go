@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+func snapshotNodes(provider MetricsProvider) map[nodeKey]NodeSnapshot {
+	nodes := make(map[nodeKey]NodeSnapshot)
+	for _, node := range provider.Snapshot().Nodes {
+		nodes[nodeKey{balancer: node.Balancer, address: node.Address}] = node
+	}
+	return nodes
+}
+
+func updateAddresses(t *testing.T, bal *customBalancer, addrs ...string) {
+	t.Helper()
+	state := resolver.State{}
+	for _, addr := range addrs {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+	}
+	if err := bal.UpdateClientConnState(balancer.ClientConnState{ResolverState: state}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Балансировщики одного builder-а пишут в общие метрики, но обновление адресов одного из них
+// не должно удалять метрики нод другого.
+func TestSharedMetricsRetainPerBalancer(t *testing.T) {
+	first, second := listen(t), listen(t)
+	builder := NewBuilder(BalancerConfig{HealthCheckInterval: time.Hour, HealthCheckTimeout: time.Second, MaxFails: 3})
+	provider := builder.(MetricsProvider)
+
+	balFirst := builder.Build(newFakeClientConn(), balancer.BuildOptions{}).(*customBalancer)
+	balSecond := builder.Build(newFakeClientConn(), balancer.BuildOptions{}).(*customBalancer)
+	defer balSecond.Close()
+
+	updateAddresses(t, balFirst, first)
+	updateAddresses(t, balSecond, first, second)
+	got := snapshotNodes(provider)
+	if len(got) != 3 {
+		t.Fatalf("want nodes of both balancers kept separately, got %v", got)
+	}
+
+	// адрес, общий с другим балансировщиком, удаляется только из метрик того, у кого он пропал
+	updateAddresses(t, balSecond, second)
+	got = snapshotNodes(provider)
+	if _, exists := got[nodeKey{balFirst.id, first}]; !exists || len(got) != 2 {
+		t.Fatalf("want %s kept for the first balancer, got %v", first, got)
+	}
+
+	balFirst.Close()
+	got = snapshotNodes(provider)
+	if _, exists := got[nodeKey{balSecond.id, second}]; !exists || len(got) != 1 {
+		t.Fatalf("want only %s of the second balancer after closing the first, got %v", second, got)
+	}
+}
+
+// Два ClientConn-а с общим адресом не перетирают друг другу состояние circuit breaker-а.
+func TestSharedAddressMetricsPerBalancer(t *testing.T) {
+	addr := listen(t)
+	builder := NewBuilder(BalancerConfig{HealthCheckInterval: time.Hour, HealthCheckTimeout: time.Second, MaxFails: 3})
+	provider := builder.(MetricsProvider)
+
+	balFirst := builder.Build(newFakeClientConn(), balancer.BuildOptions{}).(*customBalancer)
+	defer balFirst.Close()
+	balSecond := builder.Build(newFakeClientConn(), balancer.BuildOptions{}).(*customBalancer)
+	defer balSecond.Close()
+	updateAddresses(t, balFirst, addr)
+	updateAddresses(t, balSecond, addr)
+
+	balFirst.mu.Lock()
+	balFirst.openCircuit(balFirst.nodeByAddress(addr))
+	balFirst.mu.Unlock()
+
+	got := snapshotNodes(provider)
+	first, second := got[nodeKey{balFirst.id, addr}], got[nodeKey{balSecond.id, addr}]
+	if first.State != "open" || first.StateTransitions != 1 {
+		t.Fatalf("want open circuit with one transition for the first balancer, got %+v", first)
+	}
+	if second.State != "closed" || second.StateTransitions != 0 {
+		t.Fatalf("want untouched closed circuit for the second balancer, got %+v", second)
+	}
+}
+
+// Done и health-check, пришедшие после удаления ноды, не возвращают ее в метрики.
+func TestLateCallbacksDoNotRestoreRemovedNode(t *testing.T) {
+	removed, kept := listen(t), listen(t)
+	cc := newFakeClientConn()
+	builder := NewBuilder(BalancerConfig{HealthCheckInterval: time.Hour, HealthCheckTimeout: time.Second, MaxFails: 3})
+	bal := builder.Build(cc, balancer.BuildOptions{}).(*customBalancer)
+	defer bal.Close()
+
+	updateAddresses(t, bal, removed)
+	bal.UpdateSubConnState(cc.subConn(removed), balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	result, err := bal.Pick(balancer.PickInfo{FullMethodName: "/test.Service/Get"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshotNodes(bal); got[nodeKey{bal.id, removed}].HealthChecks != 1 {
+		t.Fatalf("want the first health check counted, got %+v", got)
+	}
+
+	updateAddresses(t, bal, kept)
+	result.Done(balancer.DoneInfo{Err: status.Error(codes.Unavailable, "late")})
+	hc := HealthCheckerEx{timeout: time.Second, metrics: bal.metrics, balancer: bal.id}
+	hc.Check(removed)
+
+	got := snapshotNodes(bal)
+	if _, exists := got[nodeKey{bal.id, removed}]; exists || len(got) != 1 {
+		t.Fatalf("want only %s in metrics, got %v", kept, got)
+	}
+}
+
+// scriptMetrics проигрывает фиксированный набор событий для одной ноды.
+func scriptMetrics(m *balancerMetrics) (uint64, string) {
+	id := m.register()
+	addr := "10.0.0.1:50051"
+	m.recordNode(id, Node{address: addr, zone: "eu-1a", state: Closed, ready: true})
+	m.recordDone(id, addr, 3*time.Millisecond, nil)
+	m.recordDone(id, addr, 70*time.Millisecond, status.Error(codes.Unavailable, "down"))
+	m.recordDone(id, addr, 20*time.Second, status.Error(codes.Unavailable, "down"))
+	m.recordDone(id, addr, 20*time.Millisecond, status.Error(codes.Internal, "boom"))
+	m.recordState(id, addr, Open)
+	m.recordHealthCheck(id, addr, nil)
+	m.recordHealthCheck(id, addr, errors.New("connection refused"))
+	m.recordEjection(id, addr, true)
+	for i := 0; i < pickHistorySize+5; i++ {
+		m.recordPick(id, fmt.Sprintf("/test.Service/Get%d", i), addr, nil)
+	}
+	return id, addr
+}
+
+func TestMetricsSnapshot(t *testing.T) {
+	m := newBalancerMetrics()
+	id, addr := scriptMetrics(m)
+
+	snapshot := m.snapshot()
+	if len(snapshot.Nodes) != 1 {
+		t.Fatalf("want one node, got %+v", snapshot.Nodes)
+	}
+	node := snapshot.Nodes[0]
+	if node.Balancer != id || node.Address != addr || node.Zone != "eu-1a" || !node.Ready {
+		t.Fatalf("unexpected node info: %+v", node)
+	}
+	if node.Requests != 4 || node.Errors != 3 || node.ErrorsByCode["Unavailable"] != 2 || node.ErrorsByCode["Internal"] != 1 {
+		t.Fatalf("unexpected RED counters: %+v", node)
+	}
+	if node.RequestRate != 4.0/rateWindow {
+		t.Fatalf("want request rate %v, got %v", 4.0/rateWindow, node.RequestRate)
+	}
+
+	// 3ms -> 0.005, 20ms -> 0.025, 70ms -> 0.1, 20s -> +Inf
+	wantCounts := make([]uint64, len(latencyBuckets)+1)
+	wantCounts[0], wantCounts[2], wantCounts[4], wantCounts[len(latencyBuckets)] = 1, 1, 1, 1
+	for idx := range wantCounts {
+		if node.Latency.Counts[idx] != wantCounts[idx] {
+			t.Fatalf("want latency counts %v, got %v", wantCounts, node.Latency.Counts)
+		}
+	}
+	if node.Latency.Count != 4 || math.Abs(node.Latency.Sum-20.093) > 1e-9 {
+		t.Fatalf("want 4 latencies with sum 20.093, got %d and %v", node.Latency.Count, node.Latency.Sum)
+	}
+
+	if node.State != "open" || node.StateTransitions != 1 || node.LastTransition.IsZero() {
+		t.Fatalf("want one transition to open, got %+v", node)
+	}
+	if node.HealthChecks != 2 || node.HealthCheckFailures != 1 || node.LastHealthCheckErr != "connection refused" {
+		t.Fatalf("unexpected health checks: %+v", node)
+	}
+	if !node.Ejected || node.Ejections != 1 {
+		t.Fatalf("want node ejected once, got %+v", node)
+	}
+
+	// в истории остаются последние pickHistorySize pick-ов, от старых к новым
+	if len(snapshot.Picks) != pickHistorySize {
+		t.Fatalf("want %d picks, got %d", pickHistorySize, len(snapshot.Picks))
+	}
+	if first, last := snapshot.Picks[0], snapshot.Picks[pickHistorySize-1]; first.Method != "/test.Service/Get5" ||
+		last.Method != fmt.Sprintf("/test.Service/Get%d", pickHistorySize+4) || first.Balancer != id || first.Address != addr {
+		t.Fatalf("unexpected pick history bounds: %+v, %+v", first, last)
+	}
+}
+
+func TestMetricsHandlerPrometheusFormat(t *testing.T) {
+	builder := NewBuilder(BalancerConfig{}).(*customBalancer)
+	id, addr := scriptMetrics(builder.metrics)
+
+	recorder := httptest.NewRecorder()
+	builder.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+	body, _ := io.ReadAll(recorder.Body)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+
+	nodeLabels := fmt.Sprintf(`balancer="customGRPCBalancer",conn="%d",node=%q,zone="eu-1a"`, id, addr)
+	want := []string{
+		"# TYPE grpc_balancer_requests_total counter",
+		"grpc_balancer_requests_total{" + nodeLabels + "} 4",
+		"# TYPE grpc_balancer_errors_total counter",
+		"grpc_balancer_errors_total{" + nodeLabels + `,code="Internal"} 1`,
+		"grpc_balancer_errors_total{" + nodeLabels + `,code="Unavailable"} 2`,
+		"# TYPE grpc_balancer_request_duration_seconds histogram",
+		"grpc_balancer_request_duration_seconds_bucket{" + nodeLabels + `,le="0.005"} 1`,
+		"grpc_balancer_request_duration_seconds_bucket{" + nodeLabels + `,le="0.01"} 1`,
+		"grpc_balancer_request_duration_seconds_bucket{" + nodeLabels + `,le="0.025"} 2`,
+		"grpc_balancer_request_duration_seconds_bucket{" + nodeLabels + `,le="0.1"} 3`,
+		"grpc_balancer_request_duration_seconds_bucket{" + nodeLabels + `,le="10"} 3`,
+		"grpc_balancer_request_duration_seconds_bucket{" + nodeLabels + `,le="+Inf"} 4`,
+		"grpc_balancer_request_duration_seconds_count{" + nodeLabels + "} 4",
+		"# TYPE grpc_balancer_circuit_state gauge",
+		"grpc_balancer_circuit_state{" + nodeLabels + `,state="open"} 1`,
+		"grpc_balancer_circuit_state{" + nodeLabels + `,state="closed"} 0`,
+		"grpc_balancer_circuit_transitions_total{" + nodeLabels + "} 1",
+		"grpc_balancer_node_ready{" + nodeLabels + "} 1",
+		"grpc_balancer_outlier_ejected{" + nodeLabels + "} 1",
+		"grpc_balancer_outlier_ejections_total{" + nodeLabels + "} 1",
+		"grpc_balancer_health_checks_total{" + nodeLabels + `,result="success"} 1`,
+		"grpc_balancer_health_checks_total{" + nodeLabels + `,result="failure"} 1`,
+	}
+	present := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		present[line] = true
+		// каждая строка - комментарий HELP/TYPE или "имя{метки} значение"
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		name, rest, ok := strings.Cut(line, "{")
+		labels, value, ok2 := strings.Cut(rest, "} ")
+		if !ok || !ok2 || !strings.HasPrefix(name, "grpc_balancer_") || labels == "" || strings.Contains(value, " ") {
+			t.Fatalf("malformed metric line %q", line)
+		}
+	}
+	for _, line := range want {
+		if !present[line] {
+			t.Errorf("missing line %q", line)
+		}
+	}
+}
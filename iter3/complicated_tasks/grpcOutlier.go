@@ -0,0 +1,254 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+
+Outlier detection (outlier ejection) для customBalancer.
+
+Circuit breaker реагирует только на жесткие отказы ноды, а outlier detection выкидывает из балансировки ноды,
+которые работают статистически хуже соседей. Раз в Interval по накопленной за интервал статистике запросов:
+
+ - success rate: нода исключается, если ее доля успешных запросов ниже mean - SuccessRateStdevFactor * stddev
+ - latency: нода исключается, если ее средняя latency выше mean + LatencyStdevFactor * stddev
+
+Кроме того, нода исключается сразу, как только получила ConsecutiveErrors ошибок подряд с кодами из ErrorCodes
+(аналог подряд идущих 5xx в HTTP). Остальные коды (NotFound, InvalidArgument и т.д.) - ошибки клиента, а не ноды,
+поэтому они считаются успешными ответами.
+
+Одновременно может быть исключено не больше MaxEjectionPercent нод. Время исключения растет с каждым повторным
+исключением (BaseEjectionTime * количество исключений, но не больше MaxEjectionTime), а за каждый интервал
+без исключения счетчик уменьшается.
+
+*/
+
+var defaultOutlierErrorCodes = []codes.Code{
+	codes.Unknown,
+	codes.DeadlineExceeded,
+	codes.Unimplemented,
+	codes.Internal,
+	codes.Unavailable,
+	codes.DataLoss,
+}
+
+// OutlierConfig - настройки outlier detection. Нулевой Interval выключает детектор,
+// для остальных нулевых полей используются значения по умолчанию.
+type OutlierConfig struct {
+	Interval               time.Duration // период анализа статистики
+	BaseEjectionTime       time.Duration
+	MaxEjectionTime        time.Duration
+	MaxEjectionPercent     int     // максимальный процент одновременно исключенных нод
+	SuccessRateStdevFactor float64 // множитель stddev для success rate
+	LatencyStdevFactor     float64 // множитель stddev для latency
+	MinimumHosts           int     // минимальное количество нод с достаточной статистикой для статистических проверок
+	RequestVolume          int     // минимальное количество запросов к ноде за интервал, чтобы учитывать ее в статистике
+	ConsecutiveErrors      int
+	ErrorCodes             []codes.Code // коды, которые считаются отказом ноды
+}
+
+type outlierStats struct {
+	successes         int
+	failures          int
+	latencySum        time.Duration
+	consecutiveErrors int
+	ejectedUntil      time.Time // нулевое значение - нода не исключена
+	ejections         int       // множитель времени исключения
+}
+
+type outlierDetector struct {
+	cfg      OutlierConfig
+	stats    map[string]*outlierStats
+	metrics  *balancerMetrics
+	balancer uint64 // номер балансировщика в метриках
+	mu       *sync.Mutex
+}
+
+func newOutlierDetector(cfg OutlierConfig, metrics *balancerMetrics, balancer uint64) *outlierDetector {
+	if cfg.BaseEjectionTime <= 0 {
+		cfg.BaseEjectionTime = 30 * time.Second
+	}
+	if cfg.MaxEjectionTime < cfg.BaseEjectionTime {
+		cfg.MaxEjectionTime = max(300*time.Second, cfg.BaseEjectionTime)
+	}
+	if cfg.MaxEjectionPercent <= 0 {
+		cfg.MaxEjectionPercent = 10
+	}
+	if cfg.SuccessRateStdevFactor <= 0 {
+		cfg.SuccessRateStdevFactor = 1.9
+	}
+	if cfg.LatencyStdevFactor <= 0 {
+		cfg.LatencyStdevFactor = 3
+	}
+	if cfg.MinimumHosts <= 0 {
+		cfg.MinimumHosts = 5
+	}
+	if cfg.RequestVolume <= 0 {
+		cfg.RequestVolume = 100
+	}
+	if cfg.ConsecutiveErrors <= 0 {
+		cfg.ConsecutiveErrors = 5
+	}
+	if len(cfg.ErrorCodes) == 0 {
+		cfg.ErrorCodes = defaultOutlierErrorCodes
+	}
+
+	return &outlierDetector{
+		cfg:      cfg,
+		stats:    make(map[string]*outlierStats),
+		metrics:  metrics,
+		balancer: balancer,
+		mu:       &sync.Mutex{},
+	}
+}
+
+func (d *outlierDetector) enabled() bool {
+	return d.cfg.Interval > 0
+}
+
+// retain синхронизирует статистику со списком нод от resolver-а.
+func (d *outlierDetector) retain(nodes []Node) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for address := range d.stats {
+		if !slices.ContainsFunc(nodes, func(node Node) bool { return node.address == address }) {
+			delete(d.stats, address)
+		}
+	}
+	for _, node := range nodes {
+		if _, exists := d.stats[node.address]; !exists {
+			d.stats[node.address] = &outlierStats{}
+		}
+	}
+}
+
+func (d *outlierDetector) isEjected(address string) bool {
+	if !d.enabled() {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats, exists := d.stats[address]
+	return exists && !stats.ejectedUntil.IsZero()
+}
+
+// recordDone учитывает результат RPC. Вызывается из PickResult.Done.
+func (d *outlierDetector) recordDone(address string, latency time.Duration, err error) {
+	if !d.enabled() {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats, exists := d.stats[address]
+	if !exists {
+		return
+	}
+	stats.latencySum += latency
+
+	if err == nil || !slices.Contains(d.cfg.ErrorCodes, status.Code(err)) {
+		stats.successes++
+		stats.consecutiveErrors = 0
+		return
+	}
+
+	stats.failures++
+	stats.consecutiveErrors++
+	if stats.consecutiveErrors >= d.cfg.ConsecutiveErrors && stats.ejectedUntil.IsZero() {
+		d.eject(address, stats, time.Now())
+	}
+}
+
+// eject исключает ноду, если не превышен MaxEjectionPercent. Вызывать под мьютексом.
+func (d *outlierDetector) eject(address string, stats *outlierStats, now time.Time) bool {
+	ejected := 0
+	for _, s := range d.stats {
+		if !s.ejectedUntil.IsZero() {
+			ejected++
+		}
+	}
+	if ejected*100 >= d.cfg.MaxEjectionPercent*len(d.stats) {
+		return false
+	}
+
+	stats.ejections++
+	stats.ejectedUntil = now.Add(min(d.cfg.BaseEjectionTime*time.Duration(stats.ejections), d.cfg.MaxEjectionTime))
+	stats.consecutiveErrors = 0
+	d.metrics.recordEjection(d.balancer, address, true)
+	return true
+}
+
+// evaluate запускается раз в Interval: применяет статистические проверки к накопленной за интервал
+// статистике, возвращает в балансировку ноды с истекшим временем исключения и сбрасывает счетчики.
+func (d *outlierDetector) evaluate(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	addresses := make([]string, 0, len(d.stats))
+	for address, stats := range d.stats {
+		if stats.successes+stats.failures >= d.cfg.RequestVolume {
+			addresses = append(addresses, address)
+		}
+	}
+	slices.Sort(addresses)
+
+	if len(addresses) >= d.cfg.MinimumHosts {
+		successRates := make([]float64, 0, len(addresses))
+		latencies := make([]float64, 0, len(addresses))
+		for _, address := range addresses {
+			stats := d.stats[address]
+			total := stats.successes + stats.failures
+			successRates = append(successRates, float64(stats.successes)/float64(total))
+			latencies = append(latencies, float64(stats.latencySum)/float64(total))
+		}
+
+		mean, stddev := meanStddev(successRates)
+		successThreshold := mean - d.cfg.SuccessRateStdevFactor*stddev
+		mean, stddev = meanStddev(latencies)
+		latencyThreshold := mean + d.cfg.LatencyStdevFactor*stddev
+
+		for idx, address := range addresses {
+			stats := d.stats[address]
+			if !stats.ejectedUntil.IsZero() {
+				continue
+			}
+			if successRates[idx] < successThreshold || latencies[idx] > latencyThreshold {
+				d.eject(address, stats, now)
+			}
+		}
+	}
+
+	for address, stats := range d.stats {
+		switch {
+		case stats.ejectedUntil.IsZero() && stats.ejections > 0:
+			stats.ejections--
+		case !stats.ejectedUntil.IsZero() && !now.Before(stats.ejectedUntil):
+			stats.ejectedUntil = time.Time{}
+			d.metrics.recordEjection(d.balancer, address, false)
+		}
+		stats.successes = 0
+		stats.failures = 0
+		stats.latencySum = 0
+	}
+}
+
+func meanStddev(values []float64) (float64, float64) {
+	var sum float64
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+
+	var variance float64
+	for _, value := range values {
+		variance += (value - mean) * (value - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(values)))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestOutlierDetector(t *testing.T, cfg OutlierConfig, addresses ...string) (*outlierDetector, *balancerMetrics) {
+	t.Helper()
+	if cfg.Interval == 0 {
+		cfg.Interval = time.Second
+	}
+	metrics := newBalancerMetrics()
+	id := metrics.register()
+	nodes := make([]Node, 0, len(addresses))
+	for _, address := range addresses {
+		nodes = append(nodes, Node{address: address})
+		metrics.recordNode(id, Node{address: address})
+	}
+	d := newOutlierDetector(cfg, metrics, id)
+	d.retain(nodes)
+	return d, metrics
+}
+
+func nodeAddresses(n int) []string {
+	addresses := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		addresses = append(addresses, fmt.Sprintf("10.0.0.%d:50051", i+1))
+	}
+	return addresses
+}
+
+// recordRequests учитывает successes успешных и failures неуспешных запросов к ноде.
+func recordRequests(d *outlierDetector, address string, successes, failures int) {
+	for i := 0; i < successes; i++ {
+		d.recordDone(address, 10*time.Millisecond, nil)
+	}
+	for i := 0; i < failures; i++ {
+		d.recordDone(address, 10*time.Millisecond, status.Error(codes.Internal, "boom"))
+	}
+}
+
+func ejectedAddresses(d *outlierDetector, addresses []string) []string {
+	ejected := make([]string, 0)
+	for _, address := range addresses {
+		if d.isEjected(address) {
+			ejected = append(ejected, address)
+		}
+	}
+	return ejected
+}
+
+func TestOutlierSuccessRateEjection(t *testing.T) {
+	addresses := nodeAddresses(6)
+	d, metrics := newTestOutlierDetector(t, OutlierConfig{RequestVolume: 20, ConsecutiveErrors: 1000}, addresses...)
+
+	// 4 ноды без ошибок, одна с 5% ошибок и одна с 50%: порог mean - 1.9 * stddev ≈ 56%
+	for _, address := range addresses[:4] {
+		recordRequests(d, address, 20, 0)
+	}
+	recordRequests(d, addresses[4], 19, 1)
+	recordRequests(d, addresses[5], 10, 10)
+
+	now := time.Now()
+	d.evaluate(now)
+	if ejected := ejectedAddresses(d, addresses); len(ejected) != 1 || ejected[0] != addresses[5] {
+		t.Fatalf("want only %s ejected, got %v", addresses[5], ejected)
+	}
+	snapshot := metrics.snapshot()
+	if node := snapshot.Nodes[5]; !node.Ejected || node.Ejections != 1 {
+		t.Fatalf("want ejection in metrics, got %+v", node)
+	}
+
+	// статистика сбрасывается каждый интервал, нода возвращается после BaseEjectionTime
+	d.evaluate(now.Add(30 * time.Second))
+	if ejected := ejectedAddresses(d, addresses); len(ejected) != 0 {
+		t.Fatalf("want node back after ejection time, got %v", ejected)
+	}
+	if node := metrics.snapshot().Nodes[5]; node.Ejected {
+		t.Fatalf("want node back in metrics, got %+v", node)
+	}
+}
+
+func TestOutlierSuccessRateNeedsEnoughStatistics(t *testing.T) {
+	addresses := nodeAddresses(6)
+	d, _ := newTestOutlierDetector(t, OutlierConfig{RequestVolume: 20, ConsecutiveErrors: 1000}, addresses...)
+
+	// у плохой ноды слишком мало запросов за интервал, а нод с достаточной статистикой меньше MinimumHosts
+	for _, address := range addresses[:4] {
+		recordRequests(d, address, 20, 0)
+	}
+	recordRequests(d, addresses[5], 5, 10)
+	d.evaluate(time.Now())
+	if ejected := ejectedAddresses(d, addresses); len(ejected) != 0 {
+		t.Fatalf("want no ejection without enough statistics, got %v", ejected)
+	}
+}
+
+func TestOutlierConsecutiveErrors(t *testing.T) {
+	addresses := nodeAddresses(4)
+	d, _ := newTestOutlierDetector(t, OutlierConfig{ConsecutiveErrors: 3, MaxEjectionPercent: 50}, addresses...)
+	address := addresses[0]
+
+	// успешный ответ сбрасывает счетчик, ошибки клиента отказом ноды не считаются и тоже его сбрасывают
+	recordRequests(d, address, 0, 2)
+	recordRequests(d, address, 1, 0)
+	recordRequests(d, address, 0, 2)
+	d.recordDone(address, time.Millisecond, status.Error(codes.NotFound, "no such item"))
+	recordRequests(d, address, 0, 2)
+	if d.isEjected(address) {
+		t.Fatal("want node kept: errors were not consecutive node failures")
+	}
+
+	recordRequests(d, address, 0, 1)
+	if !d.isEjected(address) {
+		t.Fatal("want node ejected right after 3 consecutive errors")
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	addresses := nodeAddresses(4)
+	d, _ := newTestOutlierDetector(t, OutlierConfig{ConsecutiveErrors: 1, MaxEjectionPercent: 50}, addresses...)
+
+	// падают 3 ноды из 4, но исключить можно не больше половины
+	for _, address := range addresses[:3] {
+		recordRequests(d, address, 0, 1)
+	}
+	if ejected := ejectedAddresses(d, addresses); len(ejected) != 2 {
+		t.Fatalf("want 2 of 4 nodes ejected, got %v", ejected)
+	}
+
+	// статистические проверки тоже не выходят за лимит
+	addresses = nodeAddresses(10)
+	d, _ = newTestOutlierDetector(t, OutlierConfig{RequestVolume: 10, ConsecutiveErrors: 1000, MaxEjectionPercent: 10}, addresses...)
+	for _, address := range addresses[:8] {
+		recordRequests(d, address, 10, 0)
+	}
+	for _, address := range addresses[8:] {
+		recordRequests(d, address, 0, 10)
+	}
+	d.evaluate(time.Now())
+	if ejected := ejectedAddresses(d, addresses); len(ejected) != 1 {
+		t.Fatalf("want 1 of 10 nodes ejected, got %v", ejected)
+	}
+}
+
+func TestOutlierRepeatOffenderEjectedLonger(t *testing.T) {
+	addresses := nodeAddresses(2)
+	d, _ := newTestOutlierDetector(t, OutlierConfig{
+		ConsecutiveErrors:  1,
+		MaxEjectionPercent: 50,
+		BaseEjectionTime:   10 * time.Second,
+		MaxEjectionTime:    25 * time.Second,
+	}, addresses...)
+	address := addresses[0]
+
+	// ejectFor исключает ноду и возвращает, на сколько ее исключили
+	ejectFor := func() (time.Duration, time.Time) {
+		t.Helper()
+		before := time.Now()
+		recordRequests(d, address, 0, 1)
+		d.mu.Lock()
+		until := d.stats[address].ejectedUntil
+		d.mu.Unlock()
+		if until.IsZero() {
+			t.Fatal("want node ejected")
+		}
+		return until.Sub(before).Truncate(time.Second), until
+	}
+	release := func(until time.Time) {
+		t.Helper()
+		d.evaluate(until.Add(-time.Millisecond))
+		if !d.isEjected(address) {
+			t.Fatal("want node ejected until the ejection time ends")
+		}
+		d.evaluate(until)
+		if d.isEjected(address) {
+			t.Fatal("want node back after the ejection time")
+		}
+	}
+
+	for _, want := range []time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second} {
+		ejection, until := ejectFor()
+		if ejection != want {
+			t.Fatalf("want ejection for %v, got %v", want, ejection)
+		}
+		release(until)
+	}
+
+	// за интервалы без исключений множитель уменьшается
+	d.evaluate(time.Now())
+	d.evaluate(time.Now())
+	if ejection, _ := ejectFor(); ejection != 20*time.Second {
+		t.Fatalf("want ejection time to decay to 20s, got %v", ejection)
+	}
+}
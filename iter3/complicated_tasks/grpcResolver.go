@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+
+Resolver для customBalancer: источник адресов бэкендов.
+
+Адреса берутся из EndpointSource - локального JSON/YAML файла (замена DNS / Service Discovery)
+или in-memory реестра для тестов. Resolver перечитывает источник по таймеру и при вызове ResolveNow,
+а вес, зону и версию бэкенда кладет в resolver.Address.BalancerAttributes, откуда их читает балансировщик.
+
+Пример файла с адресами (endpoints.yaml):
+
+endpoints:
+  - addr: 10.0.0.1:50051
+    weight: 2
+    zone: eu-1a
+    version: v1.2.0
+  - addr: 10.0.0.2:50051
+    zone: eu-1b
+
+*/
+
+const (
+	defaultResolverScheme  = "custom"
+	defaultRefreshInterval = 30 * time.Second
+)
+
+// ключи атрибутов адреса, которые заполняет resolver
+type weightKey struct{}
+type zoneKey struct{}
+type versionKey struct{}
+
+type Endpoint struct {
+	Addr    string `json:"addr" yaml:"addr"`
+	Weight  uint32 `json:"weight" yaml:"weight"`
+	Zone    string `json:"zone" yaml:"zone"`
+	Version string `json:"version" yaml:"version"`
+}
+
+type EndpointSource interface {
+	Endpoints() ([]Endpoint, error)
+}
+
+// endpointWatcher - источник, который сам умеет сообщать об изменениях (например, MemoryRegistry).
+// Для таких источников resolver не ждет таймера, а перечитывает адреса сразу.
+type endpointWatcher interface {
+	watch() (<-chan struct{}, func())
+}
+
+type endpointsFile struct {
+	Endpoints []Endpoint `json:"endpoints" yaml:"endpoints"`
+}
+
+// FileSource читает адреса из локального JSON или YAML файла. Формат определяется по расширению.
+type FileSource struct {
+	path string
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+func (fs *FileSource) Endpoints() ([]Endpoint, error) {
+	content, err := os.ReadFile(fs.path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := endpointsFile{}
+	switch strings.ToLower(filepath.Ext(fs.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &file)
+	default:
+		err = json.Unmarshal(content, &file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return file.Endpoints, nil
+}
+
+// MemoryRegistry - in-memory реестр адресов для тестов. Set сразу оповещает все resolver-ы.
+type MemoryRegistry struct {
+	endpoints []Endpoint
+	watchers  map[chan struct{}]struct{}
+	mu        *sync.RWMutex
+}
+
+func NewMemoryRegistry(endpoints ...Endpoint) *MemoryRegistry {
+	return &MemoryRegistry{
+		endpoints: slices.Clone(endpoints),
+		watchers:  make(map[chan struct{}]struct{}),
+		mu:        &sync.RWMutex{},
+	}
+}
+
+func (r *MemoryRegistry) Set(endpoints []Endpoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endpoints = slices.Clone(endpoints)
+	for watcher := range r.watchers {
+		select {
+		case watcher <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *MemoryRegistry) Endpoints() ([]Endpoint, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.endpoints), nil
+}
+
+func (r *MemoryRegistry) watch() (<-chan struct{}, func()) {
+	watcher := make(chan struct{}, 1)
+	r.mu.Lock()
+	r.watchers[watcher] = struct{}{}
+	r.mu.Unlock()
+
+	return watcher, func() {
+		r.mu.Lock()
+		delete(r.watchers, watcher)
+		r.mu.Unlock()
+	}
+}
+
+type ResolverConfig struct {
+	Scheme          string
+	RefreshInterval time.Duration // период перечитывания источника
+}
+
+type resolverBuilder struct {
+	cfg    ResolverConfig
+	source EndpointSource
+}
+
+func NewResolverBuilder(cfg ResolverConfig, source EndpointSource) resolver.Builder {
+	if cfg.Scheme == "" {
+		cfg.Scheme = defaultResolverScheme
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = defaultRefreshInterval
+	}
+	return resolverBuilder{cfg: cfg, source: source}
+}
+
+func (rb resolverBuilder) Scheme() string {
+	return rb.cfg.Scheme
+}
+
+func (rb resolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	r := &customResolver{
+		source:         rb.source,
+		cc:             cc,
+		resolveNowChan: make(chan struct{}, 1),
+		stopChan:       make(chan struct{}),
+		wg:             &sync.WaitGroup{},
+	}
+
+	var updates <-chan struct{}
+	unwatch := func() {}
+	if watcher, ok := rb.source.(endpointWatcher); ok {
+		updates, unwatch = watcher.watch()
+	}
+
+	// первый раз резолвим синхронно, чтобы у ClientConn сразу появились адреса
+	r.resolve()
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer unwatch()
+		ticker := time.NewTicker(rb.cfg.RefreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stopChan:
+				return
+			case <-ticker.C:
+			case <-r.resolveNowChan:
+			case <-updates:
+			}
+			r.resolve()
+		}
+	}()
+
+	return r, nil
+}
+
+type customResolver struct {
+	source         EndpointSource
+	cc             resolver.ClientConn
+	last           []Endpoint // последний успешно отправленный в ClientConn список адресов
+	resolveNowChan chan struct{}
+	stopChan       chan struct{}
+	wg             *sync.WaitGroup
+}
+
+// ResolveNow вызывается gRPC как подсказка, что адреса стоит перечитать (например, после ошибок соединения).
+// Сам резолвинг происходит в отдельной горутине, несколько вызовов подряд схлопываются в один.
+func (r *customResolver) ResolveNow(opts resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNowChan <- struct{}{}:
+	default:
+	}
+}
+
+func (r *customResolver) Close() {
+	close(r.stopChan)
+	r.wg.Wait()
+}
+
+func (r *customResolver) resolve() {
+	endpoints, err := r.source.Endpoints()
+	if err != nil {
+		r.cc.ReportError(err)
+		return
+	}
+
+	endpoints = slices.DeleteFunc(endpoints, func(e Endpoint) bool { return e.Addr == "" })
+	if len(endpoints) == 0 {
+		r.cc.ReportError(errors.New("No endpoints found in source"))
+		return
+	}
+	slices.SortFunc(endpoints, func(a, b Endpoint) int { return strings.Compare(a.Addr, b.Addr) })
+
+	// если ничего не изменилось - не дергаем балансировщик лишний раз
+	if slices.Equal(endpoints, r.last) {
+		return
+	}
+
+	addresses := make([]resolver.Address, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		addresses = append(addresses, endpointToAddress(endpoint))
+	}
+
+	if err := r.cc.UpdateState(resolver.State{Addresses: addresses}); err != nil {
+		return
+	}
+	r.last = endpoints
+}
+
+func endpointToAddress(endpoint Endpoint) resolver.Address {
+	weight := endpoint.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	attrs := attributes.New(weightKey{}, weight).
+		WithValue(zoneKey{}, endpoint.Zone).
+		WithValue(versionKey{}, endpoint.Version)
+
+	return resolver.Address{Addr: endpoint.Addr, BalancerAttributes: attrs}
+}
+
+// WeightFromAddress возвращает вес бэкенда, по умолчанию 1.
+func WeightFromAddress(addr resolver.Address) uint32 {
+	weight, _ := addr.BalancerAttributes.Value(weightKey{}).(uint32)
+	if weight == 0 {
+		return 1
+	}
+	return weight
+}
+
+func ZoneFromAddress(addr resolver.Address) string {
+	zone, _ := addr.BalancerAttributes.Value(zoneKey{}).(string)
+	return zone
+}
+
+func VersionFromAddress(addr resolver.Address) string {
+	version, _ := addr.BalancerAttributes.Value(versionKey{}).(string)
+	return version
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// fakeResolverConn записывает обновления, которые resolver отправляет в ClientConn.
+type fakeResolverConn struct {
+	resolver.ClientConn
+	states chan resolver.State
+	errs   chan error
+}
+
+func newFakeResolverConn() *fakeResolverConn {
+	return &fakeResolverConn{states: make(chan resolver.State, 10), errs: make(chan error, 10)}
+}
+
+func (cc *fakeResolverConn) UpdateState(state resolver.State) error {
+	cc.states <- state
+	return nil
+}
+
+func (cc *fakeResolverConn) ReportError(err error) {
+	cc.errs <- err
+}
+
+func (cc *fakeResolverConn) nextState(t *testing.T) resolver.State {
+	t.Helper()
+	select {
+	case state := <-cc.states:
+		return state
+	case err := <-cc.errs:
+		t.Fatalf("want addresses, got error %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("resolver did not send addresses")
+	}
+	return resolver.State{}
+}
+
+func (cc *fakeResolverConn) nextError(t *testing.T) error {
+	t.Helper()
+	select {
+	case err := <-cc.errs:
+		return err
+	case state := <-cc.states:
+		t.Fatalf("want error, got addresses %v", state.Addresses)
+	case <-time.After(5 * time.Second):
+		t.Fatal("resolver did not report an error")
+	}
+	return nil
+}
+
+func (cc *fakeResolverConn) noUpdates(t *testing.T) {
+	t.Helper()
+	select {
+	case state := <-cc.states:
+		t.Fatalf("want no update, got addresses %v", state.Addresses)
+	case err := <-cc.errs:
+		t.Fatalf("want no update, got error %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func buildResolver(t *testing.T, source EndpointSource, cfg ResolverConfig) (*fakeResolverConn, resolver.Resolver) {
+	t.Helper()
+	cc := newFakeResolverConn()
+	r, err := NewResolverBuilder(cfg, source).Build(resolver.Target{}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return cc, r
+}
+
+func stateEndpoints(state resolver.State) []Endpoint {
+	endpoints := make([]Endpoint, 0, len(state.Addresses))
+	for _, addr := range state.Addresses {
+		endpoints = append(endpoints, Endpoint{
+			Addr:    addr.Addr,
+			Weight:  WeightFromAddress(addr),
+			Zone:    ZoneFromAddress(addr),
+			Version: VersionFromAddress(addr),
+		})
+	}
+	return endpoints
+}
+
+// writeEndpoints подменяет файл целиком через rename, чтобы resolver не прочитал его наполовину записанным.
+func writeEndpoints(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSourceFormats(t *testing.T) {
+	want := []Endpoint{
+		{Addr: "10.0.0.1:50051", Weight: 2, Zone: "eu-1a", Version: "v1.2.0"},
+		{Addr: "10.0.0.2:50051", Zone: "eu-1b"},
+	}
+	yamlContent := `endpoints:
+  - addr: 10.0.0.1:50051
+    weight: 2
+    zone: eu-1a
+    version: v1.2.0
+  - addr: 10.0.0.2:50051
+    zone: eu-1b
+`
+	jsonContent := `{"endpoints": [
+  {"addr": "10.0.0.1:50051", "weight": 2, "zone": "eu-1a", "version": "v1.2.0"},
+  {"addr": "10.0.0.2:50051", "zone": "eu-1b"}
+]}`
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"endpoints.yaml": yamlContent,
+		"endpoints.YML":  yamlContent,
+		"endpoints.json": jsonContent,
+		"endpoints":      jsonContent, // без расширения файл читается как JSON
+	} {
+		path := filepath.Join(dir, name)
+		writeEndpoints(t, path, content)
+		got, err := NewFileSource(path).Endpoints()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("%s: want %v, got %v", name, want, got)
+		}
+	}
+
+	broken := filepath.Join(dir, "broken.json")
+	writeEndpoints(t, broken, yamlContent)
+	if _, err := NewFileSource(broken).Endpoints(); err == nil {
+		t.Fatal("want error for YAML content in a .json file")
+	}
+	if _, err := NewFileSource(filepath.Join(dir, "missing.yaml")).Endpoints(); err == nil {
+		t.Fatal("want error for a missing file")
+	}
+}
+
+func TestResolverSetsAddressAttributes(t *testing.T) {
+	registry := NewMemoryRegistry(
+		Endpoint{Addr: "10.0.0.2:50051", Zone: "eu-1b"},
+		Endpoint{Addr: ""},
+		Endpoint{Addr: "10.0.0.1:50051", Weight: 3, Zone: "eu-1a", Version: "v1.2.0"},
+	)
+	cc, _ := buildResolver(t, registry, ResolverConfig{RefreshInterval: time.Hour})
+
+	// первый резолвинг синхронный: адреса уже в ClientConn, отсортированы, пустые отброшены, вес по умолчанию 1
+	select {
+	case state := <-cc.states:
+		want := []Endpoint{
+			{Addr: "10.0.0.1:50051", Weight: 3, Zone: "eu-1a", Version: "v1.2.0"},
+			{Addr: "10.0.0.2:50051", Weight: 1, Zone: "eu-1b"},
+		}
+		if got := stateEndpoints(state); !slices.Equal(got, want) {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	default:
+		t.Fatal("want addresses right after Build")
+	}
+}
+
+func TestResolverFollowsMemoryRegistry(t *testing.T) {
+	registry := NewMemoryRegistry(Endpoint{Addr: "10.0.0.1:50051"})
+	cc, _ := buildResolver(t, registry, ResolverConfig{RefreshInterval: time.Hour})
+	cc.nextState(t)
+
+	// реестр сам оповещает resolver, таймер обновления ждать не нужно
+	registry.Set([]Endpoint{{Addr: "10.0.0.1:50051"}, {Addr: "10.0.0.3:50051", Zone: "eu-1c"}})
+	got := stateEndpoints(cc.nextState(t))
+	want := []Endpoint{{Addr: "10.0.0.1:50051", Weight: 1}, {Addr: "10.0.0.3:50051", Weight: 1, Zone: "eu-1c"}}
+	if !slices.Equal(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	// тот же список в другом порядке - балансировщик не дергается
+	registry.Set([]Endpoint{{Addr: "10.0.0.3:50051", Zone: "eu-1c"}, {Addr: "10.0.0.1:50051"}})
+	cc.noUpdates(t)
+
+	// пустой список - ошибка, а не обнуление адресов
+	registry.Set(nil)
+	if err := cc.nextError(t); err == nil {
+		t.Fatal("want error for empty registry")
+	}
+}
+
+func TestResolveNowRereadsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.yaml")
+	writeEndpoints(t, path, "endpoints:\n  - addr: 10.0.0.1:50051\n")
+	cc, r := buildResolver(t, NewFileSource(path), ResolverConfig{RefreshInterval: time.Hour})
+	cc.nextState(t)
+
+	writeEndpoints(t, path, "endpoints:\n  - addr: 10.0.0.2:50051\n    weight: 5\n")
+	cc.noUpdates(t)
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	if got := stateEndpoints(cc.nextState(t)); !slices.Equal(got, []Endpoint{{Addr: "10.0.0.2:50051", Weight: 5}}) {
+		t.Fatalf("want re-read addresses after ResolveNow, got %v", got)
+	}
+
+	// ошибка чтения уходит в ClientConn, старые адреса остаются у балансировщика
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	if err := cc.nextError(t); !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+}
+
+func TestResolverRefreshesByTimer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	writeEndpoints(t, path, `{"endpoints": [{"addr": "10.0.0.1:50051"}]}`)
+	cc, _ := buildResolver(t, NewFileSource(path), ResolverConfig{RefreshInterval: 10 * time.Millisecond})
+	cc.nextState(t)
+
+	writeEndpoints(t, path, `{"endpoints": [{"addr": "10.0.0.1:50051", "version": "v2"}]}`)
+	if got := stateEndpoints(cc.nextState(t)); !slices.Equal(got, []Endpoint{{Addr: "10.0.0.1:50051", Weight: 1, Version: "v2"}}) {
+		t.Fatalf("want version change picked up by refresh, got %v", got)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"hash/fnv"
+	"slices"
+
+	"google.golang.org/grpc/resolver"
+)
+
+/*
+
+Детерминированный subsetting для больших флотов бэкендов.
+
+Когда адресов сотни, каждому клиенту незачем держать соединение с каждым бэкендом. Клиент подключается
+только к подмножеству из SubsetSize адресов, которое выбирается по его ClientID (алгоритм deterministic
+subsetting из Google SRE book):
+
+ - бэкенды делятся на subsetCount = len(addrs) / SubsetSize непересекающихся подмножеств
+ - клиенты разбиваются на раунды по subsetCount клиентов, внутри раунда каждый клиент берет свое подмножество,
+   поэтому клиенты с последовательными ClientID нагружают бэкенды равномерно
+ - порядок бэкендов в каждом раунде свой, чтобы остаток len(addrs) % SubsetSize не оставался без трафика
+
+Вместо случайного перемешивания порядок задается хешем (раунд, адрес). Тогда, пока subsetCount не меняется,
+добавление или удаление одного бэкенда сдвигает границы подмножеств не больше чем на один адрес, и подмножество
+клиента меняется плавно. Соединения с адресами, оставшимися в подмножестве, при этом не пересоздаются.
+
+*/
+
+func subsetAddresses(addrs []resolver.Address, size int, clientID uint64) []resolver.Address {
+	if size <= 0 || len(addrs) <= size {
+		return addrs
+	}
+
+	subsetCount := uint64(len(addrs) / size)
+	round := clientID / subsetCount
+	subsetID := clientID % subsetCount
+
+	ordered := slices.Clone(addrs)
+	slices.SortFunc(ordered, func(a, b resolver.Address) int {
+		return cmp.Or(
+			cmp.Compare(addressHash(round, a.Addr), addressHash(round, b.Addr)),
+			cmp.Compare(a.Addr, b.Addr),
+		)
+	})
+
+	start := int(subsetID) * size
+	return ordered[start : start+size]
+}
+
+func addressHash(round uint64, addr string) uint64 {
+	h := fnv.New64a()
+	binary.Write(h, binary.BigEndian, round)
+	h.Write([]byte(addr))
+	return h.Sum64()
+}
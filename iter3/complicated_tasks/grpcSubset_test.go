@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"google.golang.org/grpc/resolver"
+)
+
+func subsetTestAddresses(n int) []resolver.Address {
+	addrs := make([]resolver.Address, 0, n)
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, resolver.Address{Addr: fmt.Sprintf("10.0.%d.%d:50051", i/256, i%256)})
+	}
+	return addrs
+}
+
+// clientLoad считает, сколько клиентов с ClientID от 0 до clients-1 подключено к каждому бэкенду.
+func clientLoad(t *testing.T, addrs []resolver.Address, size, clients int) map[string]int {
+	t.Helper()
+	load := make(map[string]int, len(addrs))
+	for id := 0; id < clients; id++ {
+		subset := subsetAddresses(addrs, size, uint64(id))
+		seen := make(map[string]bool, len(subset))
+		for _, addr := range subset {
+			if seen[addr.Addr] {
+				t.Fatalf("client %d: duplicate backend %s in subset", id, addr.Addr)
+			}
+			seen[addr.Addr] = true
+			load[addr.Addr]++
+		}
+		if len(subset) != size {
+			t.Fatalf("client %d: want subset of %d, got %d", id, size, len(subset))
+		}
+	}
+	return load
+}
+
+func TestSubsetSpreadsClientsEvenly(t *testing.T) {
+	// бэкенды делятся на подмножества без остатка: каждый раунд клиентов покрывает все бэкенды по одному разу
+	addrs := subsetTestAddresses(100)
+	load := clientLoad(t, addrs, 10, 100)
+	for _, addr := range addrs {
+		if load[addr.Addr] != 10 {
+			t.Fatalf("want 10 clients on every backend, got %d on %s", load[addr.Addr], addr.Addr)
+		}
+	}
+
+	// с остатком бэкенды, не попавшие в подмножества раунда, в каждом раунде разные
+	addrs = subsetTestAddresses(103)
+	load = clientLoad(t, addrs, 10, 1000)
+	low, high := load[addrs[0].Addr], load[addrs[0].Addr]
+	for _, addr := range addrs {
+		low, high = min(low, load[addr.Addr]), max(high, load[addr.Addr])
+	}
+	if low < 90 || high > 100 {
+		t.Fatalf("want 90-100 clients on every backend, got from %d to %d", low, high)
+	}
+}
+
+func TestSubsetSmallChangeKeepsSubsets(t *testing.T) {
+	addrs := subsetTestAddresses(105)
+	changes := map[string][]resolver.Address{
+		"remove": slices.Delete(slices.Clone(addrs), 42, 43),
+		"add":    append(slices.Clone(addrs), resolver.Address{Addr: "10.1.0.1:50051"}),
+	}
+
+	for name, changed := range changes {
+		moved := 0
+		for id := uint64(0); id < 100; id++ {
+			before := subsetAddresses(addrs, 10, id)
+			after := subsetAddresses(changed, 10, id)
+			dropped := 0
+			for _, addr := range before {
+				if !slices.Contains(after, addr) {
+					dropped++
+				}
+			}
+			// один бэкенд сдвигает границу подмножества не больше чем на один адрес
+			if dropped > 1 {
+				t.Fatalf("%s: client %d lost %d backends: %v -> %v", name, id, dropped, before, after)
+			}
+			moved += dropped
+		}
+		// из 1000 соединений всех клиентов переезжает не больше 100
+		if moved == 0 || moved > 100 {
+			t.Fatalf("%s: want some subsets shifted by one backend, %d backends moved", name, moved)
+		}
+	}
+}
+
+func TestSubsetDisabled(t *testing.T) {
+	addrs := subsetTestAddresses(5)
+	if got := subsetAddresses(addrs, 0, 3); !slices.Equal(got, addrs) {
+		t.Fatalf("want all addresses with zero SubsetSize, got %v", got)
+	}
+	if got := subsetAddresses(addrs, 5, 3); !slices.Equal(got, addrs) {
+		t.Fatalf("want all addresses when SubsetSize covers them, got %v", got)
+	}
+}